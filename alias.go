@@ -3,13 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
 	"github.com/spf13/cobra"
 )
 
@@ -19,17 +21,10 @@ var aliasPat = regexp.MustCompile(aliasPatStr)
 
 var aliasCmd *cobra.Command
 
-var unaliasCmd = &cobra.Command{
-	Use:   "unalias function-name alias-name",
-	Short: "Deletes an existing function alias",
-	Args:  cobra.ExactArgs(2),
-	RunE: func(c *cobra.Command, args []string) error {
-		return unalias(args[0], args[1])
-	},
-}
+var unaliasCmd *cobra.Command
 
 func init() {
-	var force bool
+	var force, cascade bool
 	aliasCmd = &cobra.Command{
 		Use:   "alias function-name version alias-name",
 		Short: "Create an alias for a function at a specific version",
@@ -38,25 +33,161 @@ func init() {
 			fnName := args[0]
 			version := args[1]
 			aliasName := args[2]
-			return alias(fnName, version, aliasName, force)
+			return alias(c.Context(), fnName, version, aliasName, force)
 		},
 	}
 	aliasCmd.Flags().BoolVarP(&force, "force", "f", false, "Force update existing alias")
+
+	aliasCmd.AddCommand(&cobra.Command{
+		Use:   "list function-name",
+		Short: "List the aliases of a function",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			als, err := listAliases(c.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			return formatOutput(als)
+		},
+	})
+	aliasCmd.AddCommand(&cobra.Command{
+		Use:   "describe function-name alias-name",
+		Short: "Describe an alias of a function",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(c *cobra.Command, args []string) error {
+			a, err := describeAlias(c.Context(), args[0], args[1])
+			if err != nil {
+				return err
+			}
+			return formatOutput(a)
+		},
+	})
+
+	unaliasCmd = &cobra.Command{
+		Use:   "unalias function-name alias-name",
+		Short: "Deletes an existing function alias",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(c *cobra.Command, args []string) error {
+			return unalias(c.Context(), args[0], args[1], cascade)
+		},
+	}
+	unaliasCmd.Flags().BoolVar(&cascade, "cascade", false, "Also delete the function URL of the alias and its public access permission")
+}
+
+// fnAlias represents an alias of a function.
+type fnAlias struct {
+	Name        string `json:"name"`
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	// RoutingWeights maps additional versions to the fraction of invocations
+	// routed to them. The rest go to Version.
+	RoutingWeights map[string]float64 `json:"routing_weights"`
+	URL            string             `json:"url"`
+}
+
+// newFnAlias converts the given alias configuration, looking up its function
+// URL if any.
+func newFnAlias(ctx context.Context, lambdaCl *lambda.Client, fnName string, a lambdatypes.AliasConfiguration) (fnAlias, error) {
+	fa := fnAlias{
+		Name:           aws.ToString(a.Name),
+		Description:    aws.ToString(a.Description),
+		RoutingWeights: map[string]float64{},
+	}
+	v, err := strconv.Atoi(aws.ToString(a.FunctionVersion))
+	if err != nil {
+		return fa, fmt.Errorf("failed to parse version of alias '%s': %s", fa.Name, err)
+	}
+	fa.Version = v
+	if a.RoutingConfig != nil {
+		for ver, w := range a.RoutingConfig.AdditionalVersionWeights {
+			fa.RoutingWeights[ver] = w
+		}
+	}
+
+	u, err := lambdaCl.GetFunctionUrlConfig(ctx, &lambda.GetFunctionUrlConfigInput{
+		FunctionName: &fnName,
+		Qualifier:    a.Name,
+	})
+	if err != nil {
+		if apiErrorCode(err) != "ResourceNotFoundException" {
+			return fa, fmt.Errorf("failed to get function url of alias '%s': %s", fa.Name, err)
+		}
+	} else {
+		fa.URL = aws.ToString(u.FunctionUrl)
+	}
+	return fa, nil
+}
+
+// listAliases returns the aliases of the given function sorted by name.
+func listAliases(ctx context.Context, fnName string) ([]fnAlias, error) {
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws config: %s", err)
+	}
+	lambdaCl := clients.lambda()
+
+	var cfgs []lambdatypes.AliasConfiguration
+	pag := lambda.NewListAliasesPaginator(lambdaCl, &lambda.ListAliasesInput{
+		FunctionName: &fnName,
+	})
+	for pag.HasMorePages() {
+		p, err := pag.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list aliases: %s", err)
+		}
+		cfgs = append(cfgs, p.Aliases...)
+	}
+
+	als := make([]fnAlias, len(cfgs))
+	if err := parallel(ctx, len(cfgs), func(ctx context.Context, i int) error {
+		a, err := newFnAlias(ctx, lambdaCl, fnName, cfgs[i])
+		als[i] = a
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(als, func(i, j int) bool { return als[i].Name < als[j].Name })
+	return als, nil
+}
+
+// describeAlias returns the given alias of the given function.
+func describeAlias(ctx context.Context, fnName string, aliasName string) (fnAlias, error) {
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return fnAlias{}, fmt.Errorf("failed to load aws config: %s", err)
+	}
+	lambdaCl := clients.lambda()
+
+	a, err := lambdaCl.GetAlias(ctx, &lambda.GetAliasInput{
+		FunctionName: &fnName,
+		Name:         &aliasName,
+	})
+	if err != nil {
+		if apiErrorCode(err) == "ResourceNotFoundException" {
+			return fnAlias{}, fmt.Errorf("alias '%s' of function '%s' does not exist", aliasName, fnName)
+		}
+		return fnAlias{}, fmt.Errorf("failed to get alias: %s", err)
+	}
+	return newFnAlias(ctx, lambdaCl, fnName, lambdatypes.AliasConfiguration{
+		Name:            a.Name,
+		FunctionVersion: a.FunctionVersion,
+		Description:     a.Description,
+		RoutingConfig:   a.RoutingConfig,
+	})
 }
 
 // alias creates an alias for a function at a specific version.
-func alias(fnName string, version string, aliasName string, force bool) error {
-	if !aliasPat.MatchString(aliasName) {
-		return fmt.Errorf("invalid alias name: '%s' - must match '%s'", aliasName, aliasPatStr)
+func alias(ctx context.Context, fnName string, version string, aliasName string, force bool) error {
+	if len(aliasName) > 128 || !aliasPat.MatchString(aliasName) {
+		return fmt.Errorf("invalid alias name: '%s' - must be at most 128 characters and match '%s'", aliasName, aliasPatStr)
 	}
-	ctx := context.Background()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to load aws config: %s", err)
 	}
-	lambdaCl := lambda.NewFromConfig(acfg)
+	lambdaCl := clients.lambda()
 
-	verInt, err := resolveVersion(fnName, version)
+	verInt, err := resolveVersion(ctx, fnName, version)
 
 	if _, err = lambdaCl.CreateAlias(ctx, &lambda.CreateAliasInput{
 		FunctionName:    &fnName,
@@ -82,18 +213,33 @@ func alias(fnName string, version string, aliasName string, force bool) error {
 	return nil
 }
 
-// unalias deletes an existing alias.
-func unalias(fnName, aliasName string) error {
-	ctx := context.Background()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+// unalias deletes an existing alias. If cascade is set, the function URL of
+// the alias and its public access permission are deleted first. Otherwise a
+// warning is logged if the alias has a function URL.
+func unalias(ctx context.Context, fnName, aliasName string, cascade bool) error {
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to load aws config: %s", err)
 	}
-	lambdaCl := lambda.NewFromConfig(acfg)
+	lambdaCl := clients.lambda()
 
-	if _, err = lambdaCl.DeleteAlias(ctx, &lambda.DeleteAliasInput{
+	if cascade {
+		if err := deleteAliasURL(ctx, lambdaCl, fnName, aliasName); err != nil {
+			return err
+		}
+	} else if _, err := lambdaCl.GetFunctionUrlConfig(ctx, &lambda.GetFunctionUrlConfigInput{
 		FunctionName: &fnName,
-		Name:         &aliasName,
+		Qualifier:    &aliasName,
+	}); err == nil {
+		log.Printf("warning: alias '%s' has a function URL - pass --cascade to delete it too", aliasName)
+	}
+
+	if err := retryOnResourceConflict(ctx, func() error {
+		_, err := lambdaCl.DeleteAlias(ctx, &lambda.DeleteAliasInput{
+			FunctionName: &fnName,
+			Name:         &aliasName,
+		})
+		return err
 	}); err != nil {
 		if strings.Contains(err.Error(), "404") {
 			return nil
@@ -102,3 +248,28 @@ func unalias(fnName, aliasName string) error {
 	}
 	return nil
 }
+
+// deleteAliasURL deletes the function URL of the given alias and the public
+// access permission deploy adds for it. Missing ones are ignored.
+func deleteAliasURL(ctx context.Context, lambdaCl *lambda.Client, fnName string, aliasName string) error {
+	if err := retryOnResourceConflict(ctx, func() error {
+		_, err := lambdaCl.RemovePermission(ctx, &lambda.RemovePermissionInput{
+			StatementId:  aws.String("AllowPublicAccess"),
+			FunctionName: &fnName,
+			Qualifier:    &aliasName,
+		})
+		return err
+	}); err != nil && apiErrorCode(err) != "ResourceNotFoundException" {
+		return fmt.Errorf("failed to remove public access permission from '%s' alias URL: %s", aliasName, err)
+	}
+	if err := retryOnResourceConflict(ctx, func() error {
+		_, err := lambdaCl.DeleteFunctionUrlConfig(ctx, &lambda.DeleteFunctionUrlConfigInput{
+			FunctionName: &fnName,
+			Qualifier:    &aliasName,
+		})
+		return err
+	}); err != nil && apiErrorCode(err) != "ResourceNotFoundException" {
+		return fmt.Errorf("failed to delete '%s' alias URL: %s", aliasName, err)
+	}
+	return nil
+}
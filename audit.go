@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd *cobra.Command
+
+func init() {
+	var format string
+	auditCmd = &cobra.Command{
+		Use:   "audit [function-name...]",
+		Short: "Report security issues of lambdafy functions",
+		Long: `Report security issues of lambdafy functions: public URLs, wildcard role
+policies, functions outside a VPC, secret looking env vars stored in plain
+text and images with an outdated proxy. The deployed version of each function
+is audited, or the latest if it's not deployed. All lambdafy functions are
+audited if no function names are given.`,
+		RunE: func(c *cobra.Command, args []string) error {
+			if format != "table" && format != "json" {
+				return fmt.Errorf("--format must be either 'table' or 'json'")
+			}
+			findings, err := audit(c.Context(), args)
+			if err != nil {
+				return err
+			}
+			if format == "json" || outputTemplate != "" {
+				return formatOutput(findings)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "FUNCTION\tVERSION\tSEVERITY\tCHECK\tDETAIL")
+			for _, f := range findings {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.Function, f.Version, f.Severity, f.Check, f.Detail)
+			}
+			return w.Flush()
+		},
+	}
+	auditCmd.Flags().StringVar(&format, "format", "table", "output format: table or json")
+}
+
+// Severities of audit findings.
+const (
+	severityHigh   = "high"
+	severityMedium = "medium"
+	severityLow    = "low"
+)
+
+// auditFinding is a single security issue of a function.
+type auditFinding struct {
+	Function string `json:"function"`
+	Version  string `json:"version"`
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Detail   string `json:"detail"`
+}
+
+// secretEnvNamePat matches the names of env vars which likely hold secrets.
+var secretEnvNamePat = regexp.MustCompile(`(?i)(secret|password|passwd|token|api_?key|private_?key|credential)`)
+
+// wildcardExemptActions are the actions which only support the "*" resource
+// and are needed by lambda.
+var wildcardExemptActions = map[string]bool{
+	"ec2:AssignPrivateIpAddresses":   true,
+	"ec2:CreateNetworkInterface":     true,
+	"ec2:DeleteNetworkInterface":     true,
+	"ec2:DescribeNetworkInterfaces":  true,
+	"ec2:UnassignPrivateIpAddresses": true,
+}
+
+// audit returns the security issues of the given lambdafy functions, or all of
+// them if none are given, sorted by function and severity.
+func audit(ctx context.Context, fnNames []string) ([]auditFinding, error) {
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws config: %s", err)
+	}
+	lambdaCl := clients.lambda()
+	iamCl := clients.iam()
+	ecrCl := clients.ecr()
+
+	if len(fnNames) == 0 {
+		listPages := lambda.NewListFunctionsPaginator(lambdaCl, &lambda.ListFunctionsInput{})
+		for listPages.HasMorePages() {
+			p, err := listPages.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list functions: %s", err)
+			}
+			for _, f := range p.Functions {
+				if isLambdafyFunction(f) {
+					fnNames = append(fnNames, *f.FunctionName)
+				}
+			}
+		}
+	}
+
+	proxyChksum := sha256.Sum256(proxyBinary)
+	proxyChksumHex := hex.EncodeToString(proxyChksum[:])
+
+	findings := []auditFinding{}
+	for _, fnName := range fnNames {
+		verbosef("auditing function '%s'", fnName)
+
+		fn, err := lambdaCl.GetFunction(ctx, &lambda.GetFunctionInput{
+			FunctionName: aws.String(fnName),
+			Qualifier:    aws.String(activeAlias),
+		})
+		if apiErrorCode(err) == "ResourceNotFoundException" {
+			fn, err = lambdaCl.GetFunction(ctx, &lambda.GetFunctionInput{
+				FunctionName: aws.String(fnName),
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get function '%s': %s", fnName, err)
+		}
+		cfg := fn.Configuration
+
+		add := func(severity, check, format string, v ...interface{}) {
+			findings = append(findings, auditFinding{
+				Function: fnName,
+				Version:  *cfg.Version,
+				Severity: severity,
+				Check:    check,
+				Detail:   fmt.Sprintf(format, v...),
+			})
+		}
+
+		// Public URLs
+
+		urlPages := lambda.NewListFunctionUrlConfigsPaginator(lambdaCl, &lambda.ListFunctionUrlConfigsInput{
+			FunctionName: aws.String(fnName),
+		})
+		for urlPages.HasMorePages() {
+			p, err := urlPages.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list function URLs of '%s': %s", fnName, err)
+			}
+			for _, u := range p.FunctionUrlConfigs {
+				if u.AuthType == lambdatypes.FunctionUrlAuthTypeNone {
+					add(severityMedium, "public-url", "%s has no authentication", *u.FunctionUrl)
+				}
+			}
+		}
+
+		// Wildcard role policies
+
+		actions, err := wildcardRoleActions(ctx, iamCl, *cfg.Role)
+		if err != nil {
+			add(severityLow, "role-policy", "cannot check role policies: %s", err)
+		} else if len(actions) > 0 {
+			add(severityHigh, "wildcard-role-policy", "role allows %s on all resources", strings.Join(actions, ", "))
+		}
+
+		// VPC
+
+		if cfg.VpcConfig == nil || len(cfg.VpcConfig.SubnetIds) == 0 {
+			add(severityLow, "no-vpc", "function is not in a VPC")
+		}
+
+		// Secrets in plain text env vars. Values dereferenced by the proxy (e.g.
+		// *ssm:...) are not secrets themselves.
+
+		if cfg.KMSKeyArn == nil && cfg.Environment != nil {
+			var names []string
+			for k, v := range cfg.Environment.Variables {
+				if secretEnvNamePat.MatchString(k) && !strings.HasPrefix(v, "*") && !strings.HasPrefix(k, specInEnvPrefix) {
+					names = append(names, k)
+				}
+			}
+			sort.Strings(names)
+			if len(names) > 0 {
+				add(severityHigh, "plaintext-secret-env", "env vars %s look like secrets but are not encrypted with a customer managed KMS key", strings.Join(names, ", "))
+			}
+		}
+
+		// Proxy version
+
+		if fn.Code != nil && fn.Code.ResolvedImageUri != nil {
+			labels, err := imageLabels(ctx, ecrCl, *fn.Code.ResolvedImageUri)
+			if err != nil {
+				add(severityLow, "proxy-version", "cannot check proxy version: %s", err)
+			} else if labels[proxyChecksumLabel] != proxyChksumHex {
+				add(severityMedium, "stale-proxy", "image was not lambdafied with the proxy of this lambdafy version (%s)", version)
+			}
+		}
+	}
+
+	severityOrder := map[string]int{severityHigh: 0, severityMedium: 1, severityLow: 2}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Function != findings[j].Function {
+			return findings[i].Function < findings[j].Function
+		}
+		return severityOrder[findings[i].Severity] < severityOrder[findings[j].Severity]
+	})
+	return findings, nil
+}
+
+// isLambdafyFunction returns true if the function was published by lambdafy.
+func isLambdafyFunction(f lambdatypes.FunctionConfiguration) bool {
+	if f.Environment == nil {
+		return false
+	}
+	_, ok := f.Environment.Variables[specInEnvPrefix+"CORS"]
+	return ok
+}
+
+// wildcardRoleActions returns the sorted actions allowed on all resources by
+// the inline policies of the given role, except for those which cannot be
+// scoped to specific resources and those scoped by a condition instead.
+func wildcardRoleActions(ctx context.Context, iamCl *iam.Client, roleArn string) ([]string, error) {
+	roleName := roleArn[strings.LastIndex(roleArn, "/")+1:]
+	var polNames []string
+	pages := iam.NewListRolePoliciesPaginator(iamCl, &iam.ListRolePoliciesInput{RoleName: &roleName})
+	for pages.HasMorePages() {
+		p, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list role policies: %s", err)
+		}
+		polNames = append(polNames, p.PolicyNames...)
+	}
+
+	seen := map[string]bool{}
+	var actions []string
+	for _, n := range polNames {
+		p, err := iamCl.GetRolePolicy(ctx, &iam.GetRolePolicyInput{
+			RoleName:   &roleName,
+			PolicyName: aws.String(n),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get role policy '%s': %s", n, err)
+		}
+		doc, err := canonicalizePolicyString(*p.PolicyDocument, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode role policy '%s': %s", n, err)
+		}
+		pol := struct {
+			Statement []struct {
+				Effect    string
+				Action    interface{}
+				Resource  interface{}
+				Condition interface{}
+			}
+		}{}
+		if err := json.Unmarshal([]byte(doc), &pol); err != nil {
+			return nil, fmt.Errorf("failed to decode role policy '%s': %s", n, err)
+		}
+		for _, st := range pol.Statement {
+			if st.Effect != "Allow" || st.Condition != nil || !containsString(policyStrings(st.Resource), "*") {
+				continue
+			}
+			for _, a := range policyStrings(st.Action) {
+				if !wildcardExemptActions[a] && !seen[a] {
+					seen[a] = true
+					actions = append(actions, a)
+				}
+			}
+		}
+	}
+	sort.Strings(actions)
+	return actions, nil
+}
+
+// policyStrings returns the values of a policy element which can either be a
+// single string or a list of strings.
+func policyStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var l []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				l = append(l, s)
+			}
+		}
+		return l
+	}
+	return nil
+}
+
+// containsString returns true if l contains s.
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// imageLabels returns the labels of the given ECR image, which must be pinned
+// to a digest.
+func imageLabels(ctx context.Context, ecrCl *ecr.Client, image string) (map[string]string, error) {
+	m := ecrImagePat.FindStringSubmatch(image)
+	if m == nil || m[5] == "" {
+		return nil, fmt.Errorf("'%s' is not an ECR image URI with a digest", image)
+	}
+	registry, repoName, digest := m[1], m[3], m[5]
+
+	out, err := ecrCl.BatchGetImage(ctx, &ecr.BatchGetImageInput{
+		RegistryId:     &registry,
+		RepositoryName: &repoName,
+		ImageIds:       []ecrtypes.ImageIdentifier{{ImageDigest: &digest}},
+		AcceptedMediaTypes: []string{
+			"application/vnd.docker.distribution.manifest.v2+json",
+			"application/vnd.oci.image.manifest.v1+json",
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image manifest: %s", err)
+	}
+	if len(out.Images) == 0 || out.Images[0].ImageManifest == nil {
+		return nil, fmt.Errorf("image manifest not found")
+	}
+	manifest := struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}{}
+	if err := json.Unmarshal([]byte(*out.Images[0].ImageManifest), &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode image manifest: %s", err)
+	}
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("image manifest has no config")
+	}
+
+	dl, err := ecrCl.GetDownloadUrlForLayer(ctx, &ecr.GetDownloadUrlForLayerInput{
+		RegistryId:     &registry,
+		RepositoryName: &repoName,
+		LayerDigest:    &manifest.Config.Digest,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image config URL: %s", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, *dl.DownloadUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image config: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download image config: status %d", resp.StatusCode)
+	}
+	imgCfg := struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&imgCfg); err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %s", err)
+	}
+	return imgCfg.Config.Labels, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/accessanalyzer"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/scheduler"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// awsClients loads the AWS config and creates the service clients on first use
+// so that credential resolution happens once and the clients (and their
+// connections) are shared by everything a command invocation does.
+type awsClients struct {
+	once sync.Once
+	cfg  aws.Config
+	err  error
+
+	mu       sync.Mutex
+	lambdaCl *lambda.Client
+	iamCl    *iam.Client
+	ecrCl    *ecr.Client
+	stsCl    *sts.Client
+	schedCl  *scheduler.Client
+	logsCl   *cloudwatchlogs.Client
+	ec2Cl    *ec2.Client
+	kmsCl    *kms.Client
+	aaCl     *accessanalyzer.Client
+}
+
+type awsClientsKey struct{}
+
+// withAWSClients returns a context carrying a new, not yet initialized, set of
+// AWS clients.
+func withAWSClients(ctx context.Context) context.Context {
+	return context.WithValue(ctx, awsClientsKey{}, &awsClients{})
+}
+
+// awsClientsFrom returns the AWS clients carried by the context, loading the
+// AWS config if it's the first use. A new set of clients is used if the
+// context carries none.
+func awsClientsFrom(ctx context.Context) (*awsClients, error) {
+	c, ok := ctx.Value(awsClientsKey{}).(*awsClients)
+	if !ok {
+		c = &awsClients{}
+	}
+	c.once.Do(func() {
+		c.cfg, c.err = awsconfig.LoadDefaultConfig(ctx)
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// config returns the loaded AWS config.
+func (c *awsClients) config() aws.Config {
+	return c.cfg
+}
+
+func (c *awsClients) lambda() *lambda.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lambdaCl == nil {
+		c.lambdaCl = lambda.NewFromConfig(c.cfg)
+	}
+	return c.lambdaCl
+}
+
+func (c *awsClients) iam() *iam.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.iamCl == nil {
+		c.iamCl = iam.NewFromConfig(c.cfg)
+	}
+	return c.iamCl
+}
+
+func (c *awsClients) ecr() *ecr.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ecrCl == nil {
+		c.ecrCl = ecr.NewFromConfig(c.cfg)
+	}
+	return c.ecrCl
+}
+
+func (c *awsClients) sts() *sts.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stsCl == nil {
+		c.stsCl = sts.NewFromConfig(c.cfg)
+	}
+	return c.stsCl
+}
+
+func (c *awsClients) scheduler() *scheduler.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.schedCl == nil {
+		c.schedCl = scheduler.NewFromConfig(c.cfg)
+	}
+	return c.schedCl
+}
+
+func (c *awsClients) logs() *cloudwatchlogs.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.logsCl == nil {
+		c.logsCl = cloudwatchlogs.NewFromConfig(c.cfg)
+	}
+	return c.logsCl
+}
+
+func (c *awsClients) ec2() *ec2.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ec2Cl == nil {
+		c.ec2Cl = ec2.NewFromConfig(c.cfg)
+	}
+	return c.ec2Cl
+}
+
+func (c *awsClients) kms() *kms.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.kmsCl == nil {
+		c.kmsCl = kms.NewFromConfig(c.cfg)
+	}
+	return c.kmsCl
+}
+
+func (c *awsClients) accessAnalyzer() *accessanalyzer.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aaCl == nil {
+		c.aaCl = accessanalyzer.NewFromConfig(c.cfg)
+	}
+	return c.aaCl
+}
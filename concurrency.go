@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/spf13/cobra"
+)
+
+var concurrencyCmd = &cobra.Command{
+	Use:   "concurrency",
+	Short: "Manage reserved and provisioned concurrency of a function",
+	Long: "Manage reserved and provisioned concurrency of a function. Reserved " +
+		"concurrency applies to the whole function whereas provisioned " +
+		"concurrency applies to an alias.",
+}
+
+func init() {
+	var al string
+	getCmd := &cobra.Command{
+		Use:   "get function-name",
+		Short: "Print out the concurrency settings of a function",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			conc, err := getConcurrency(c.Context(), args[0], al)
+			if err != nil {
+				return err
+			}
+			return formatOutput(conc)
+		},
+	}
+	getCmd.Flags().StringVarP(&al, "alias", "a", activeAlias, "alias to get the provisioned concurrency of")
+	concurrencyCmd.AddCommand(getCmd)
+
+	var reserved, provisioned int32
+	setCmd := &cobra.Command{
+		Use:   "set function-name",
+		Short: "Change the concurrency settings of a function",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			var res, prov *int32
+			if c.Flags().Changed("reserved") {
+				res = &reserved
+			}
+			if c.Flags().Changed("provisioned") {
+				prov = &provisioned
+			}
+			if res == nil && prov == nil {
+				return errors.New("at least one of --reserved or --provisioned must be specified")
+			}
+			return setConcurrency(c.Context(), args[0], al, res, prov)
+		},
+	}
+	setCmd.Flags().Int32Var(&reserved, "reserved", 0, "reserved concurrency of the function - 0 throttles all invocations and -1 removes the reservation")
+	setCmd.Flags().Int32Var(&provisioned, "provisioned", 0, "provisioned concurrency of the alias - 0 removes it")
+	setCmd.Flags().StringVarP(&al, "alias", "a", activeAlias, "alias to set the provisioned concurrency of")
+	concurrencyCmd.AddCommand(setCmd)
+}
+
+// fnConcurrency holds the concurrency settings of a function.
+type fnConcurrency struct {
+	// Reserved is nil if the function uses the unreserved concurrency pool.
+	Reserved    *int32                  `json:"reserved"`
+	Provisioned *provisionedConcurrency `json:"provisioned"`
+}
+
+// provisionedConcurrency holds the provisioned concurrency of an alias.
+type provisionedConcurrency struct {
+	Alias     string `json:"alias"`
+	Requested int32  `json:"requested"`
+	Allocated int32  `json:"allocated"`
+	Available int32  `json:"available"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// getConcurrency returns the reserved concurrency of the function and the
+// provisioned concurrency of the given alias.
+func getConcurrency(ctx context.Context, fnName string, alias string) (fnConcurrency, error) {
+	var conc fnConcurrency
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return conc, fmt.Errorf("failed to load aws config: %s", err)
+	}
+	lambdaCl := clients.lambda()
+
+	gfc, err := lambdaCl.GetFunctionConcurrency(ctx, &lambda.GetFunctionConcurrencyInput{
+		FunctionName: &fnName,
+	})
+	if err != nil {
+		return conc, fmt.Errorf("failed to get reserved concurrency: %s", err)
+	}
+	conc.Reserved = gfc.ReservedConcurrentExecutions
+
+	pcc, err := lambdaCl.GetProvisionedConcurrencyConfig(ctx, &lambda.GetProvisionedConcurrencyConfigInput{
+		FunctionName: &fnName,
+		Qualifier:    &alias,
+	})
+	if err != nil {
+		if apiErrorCode(err) != "ProvisionedConcurrencyConfigNotFoundException" {
+			return conc, fmt.Errorf("failed to get provisioned concurrency of '%s' alias: %s", alias, err)
+		}
+		return conc, nil
+	}
+	conc.Provisioned = &provisionedConcurrency{
+		Alias:     alias,
+		Requested: aws.ToInt32(pcc.RequestedProvisionedConcurrentExecutions),
+		Allocated: aws.ToInt32(pcc.AllocatedProvisionedConcurrentExecutions),
+		Available: aws.ToInt32(pcc.AvailableProvisionedConcurrentExecutions),
+		Status:    string(pcc.Status),
+		Reason:    aws.ToString(pcc.StatusReason),
+	}
+	return conc, nil
+}
+
+// setConcurrency changes the reserved concurrency of the function and the
+// provisioned concurrency of the given alias. Nil values are left unchanged.
+// A negative reserved concurrency removes the reservation and a zero
+// provisioned concurrency removes the provisioned concurrency config.
+func setConcurrency(ctx context.Context, fnName string, alias string, reserved *int32, provisioned *int32) error {
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load aws config: %s", err)
+	}
+	lambdaCl := clients.lambda()
+
+	if reserved != nil {
+		if *reserved < 0 {
+			if _, err := lambdaCl.DeleteFunctionConcurrency(ctx, &lambda.DeleteFunctionConcurrencyInput{
+				FunctionName: &fnName,
+			}); err != nil {
+				return fmt.Errorf("failed to remove reserved concurrency: %s", err)
+			}
+			log.Printf("removed reserved concurrency of '%s'", fnName)
+		} else {
+			if _, err := lambdaCl.PutFunctionConcurrency(ctx, &lambda.PutFunctionConcurrencyInput{
+				FunctionName:                 &fnName,
+				ReservedConcurrentExecutions: reserved,
+			}); err != nil {
+				return fmt.Errorf("failed to set reserved concurrency: %s", err)
+			}
+			log.Printf("set reserved concurrency of '%s' to %d", fnName, *reserved)
+		}
+	}
+
+	if provisioned != nil {
+		if *provisioned < 0 {
+			return errors.New("provisioned concurrency must not be negative")
+		}
+		if *provisioned == 0 {
+			if _, err := lambdaCl.DeleteProvisionedConcurrencyConfig(ctx, &lambda.DeleteProvisionedConcurrencyConfigInput{
+				FunctionName: &fnName,
+				Qualifier:    &alias,
+			}); err != nil && apiErrorCode(err) != "ProvisionedConcurrencyConfigNotFoundException" && apiErrorCode(err) != "ResourceNotFoundException" {
+				return fmt.Errorf("failed to remove provisioned concurrency of '%s' alias: %s", alias, err)
+			}
+			log.Printf("removed provisioned concurrency of '%s' alias", alias)
+		} else {
+			pcc, err := lambdaCl.PutProvisionedConcurrencyConfig(ctx, &lambda.PutProvisionedConcurrencyConfigInput{
+				FunctionName:                    &fnName,
+				Qualifier:                       &alias,
+				ProvisionedConcurrentExecutions: provisioned,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to set provisioned concurrency of '%s' alias: %s", alias, err)
+			}
+			log.Printf("set provisioned concurrency of '%s' alias to %d - allocation is %s", alias, *provisioned, pcc.Status)
+		}
+	}
+
+	return nil
+}
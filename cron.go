@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/service/scheduler"
+	schedulertypes "github.com/aws/aws-sdk-go-v2/service/scheduler/types"
+	"github.com/spf13/cobra"
+)
+
+var cronCmd = &cobra.Command{
+	Use:   "cron",
+	Short: "Manage cron triggers of a deployed function",
+	Long: "Manage cron triggers of a deployed function. Changes only last until " +
+		"the next deploy, which recreates the cron triggers from the spec.",
+}
+
+func init() {
+	cronCmd.AddCommand(&cobra.Command{
+		Use:   "enable function-name cron-name",
+		Short: "Resume a paused cron trigger",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(c *cobra.Command, args []string) error {
+			return setCronState(c.Context(), args[0], args[1], true)
+		},
+	})
+	cronCmd.AddCommand(&cobra.Command{
+		Use:   "disable function-name cron-name",
+		Short: "Pause a cron trigger",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(c *cobra.Command, args []string) error {
+			return setCronState(c.Context(), args[0], args[1], false)
+		},
+	})
+}
+
+// scheduleGroupName returns the name of the schedule group holding the cron
+// triggers of the given function.
+func scheduleGroupName(fnName string) string {
+	return fmt.Sprintf("lambdafy-%s", fnName)
+}
+
+// scheduleName returns the name of the schedule for the given cron trigger of
+// the given function.
+func scheduleName(fnName string, cronName string) string {
+	return fmt.Sprintf("lambdafy-%s-%s", fnName, cronName)
+}
+
+// setCronState enables or disables the schedule of the given cron trigger.
+func setCronState(ctx context.Context, fnName string, cronName string, enable bool) error {
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load aws config: %s", err)
+	}
+	schedCl := clients.scheduler()
+
+	groupName := scheduleGroupName(fnName)
+	name := scheduleName(fnName, cronName)
+	s, err := schedCl.GetSchedule(ctx, &scheduler.GetScheduleInput{
+		GroupName: &groupName,
+		Name:      &name,
+	})
+	if err != nil {
+		if apiErrorCode(err) == "ResourceNotFoundException" {
+			return fmt.Errorf("cron trigger '%s' of function '%s' is not deployed", cronName, fnName)
+		}
+		return fmt.Errorf("failed to get schedule: %s", err)
+	}
+
+	state := schedulertypes.ScheduleStateEnabled
+	if !enable {
+		state = schedulertypes.ScheduleStateDisabled
+	}
+	if s.State == state {
+		log.Printf("cron trigger '%s' is already %s", cronName, state)
+		return nil
+	}
+
+	// UpdateSchedule replaces the whole schedule so all fields must be passed
+	// on as is.
+
+	if _, err := schedCl.UpdateSchedule(ctx, &scheduler.UpdateScheduleInput{
+		Name:                       &name,
+		GroupName:                  &groupName,
+		ScheduleExpression:         s.ScheduleExpression,
+		ScheduleExpressionTimezone: s.ScheduleExpressionTimezone,
+		FlexibleTimeWindow:         s.FlexibleTimeWindow,
+		Target:                     s.Target,
+		Description:                s.Description,
+		StartDate:                  s.StartDate,
+		EndDate:                    s.EndDate,
+		KmsKeyArn:                  s.KmsKeyArn,
+		State:                      state,
+	}); err != nil {
+		return fmt.Errorf("failed to update schedule: %s", err)
+	}
+
+	log.Printf("cron trigger '%s' is now %s", cronName, state)
+	return nil
+}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	"github.com/aws/aws-sdk-go-v2/service/scheduler"
 	"github.com/spf13/cobra"
@@ -27,7 +26,7 @@ func init() {
 			if !yes {
 				return fmt.Errorf("must pass --yes to actually delete the '%s' function", fnName)
 			}
-			return deleteFunction(fnName)
+			return deleteFunction(c.Context(), fnName)
 		},
 	}
 	deleteCmd.Flags().BoolVarP(&yes, "yes", "y", false, "Actually delete the function")
@@ -42,23 +41,22 @@ func init() {
 }
 
 // deleteFunction deletes a function.
-func deleteFunction(name string) error {
-	ctx := context.Background()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+func deleteFunction(ctx context.Context, name string) error {
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to load aws config: %s", err)
 	}
 
-	schedCl := scheduler.NewFromConfig(acfg)
+	schedCl := clients.scheduler()
 	if _, err := schedCl.DeleteScheduleGroup(ctx, &scheduler.DeleteScheduleGroupInput{
-		Name: aws.String(fmt.Sprintf("lambdafy-%s", name)),
+		Name: aws.String(scheduleGroupName(name)),
 	}); err != nil {
 		if !strings.Contains(err.Error(), "404") {
 			return fmt.Errorf("failed to delete schedule group: %s", err)
 		}
 	}
 
-	lambdaCl := lambda.NewFromConfig(acfg)
+	lambdaCl := clients.lambda()
 
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 	defer cancel()
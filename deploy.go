@@ -4,15 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
 	"github.com/aws/aws-sdk-go-v2/service/scheduler"
@@ -31,6 +34,8 @@ var (
 
 func init() {
 	var prime int
+	var privateStaging bool
+	var scanGate scanGateOptions
 	deployCmd = &cobra.Command{
 		Use:   "deploy function-name version",
 		Short: "Deploy a specific version of a function to a public URL",
@@ -40,12 +45,12 @@ func init() {
 				return fmt.Errorf("--prime must be between 1 and 100")
 			}
 			fnName := args[0]
-			version, err := resolveVersion(fnName, args[1])
+			version, err := resolveVersion(c.Context(), fnName, args[1])
 			if err != nil {
 				return fmt.Errorf("failed to resolve version '%s': %s", args[1], err)
 			}
 
-			fnURL, err := deploy(fnName, version, prime)
+			fnURL, err := deploy(c.Context(), fnName, version, prime, privateStaging, scanGate)
 			if err != nil {
 				return err
 			}
@@ -57,6 +62,8 @@ func init() {
 		},
 	}
 	deployCmd.Flags().IntVar(&prime, "prime", 1, "prime the function by sending it concurrent requests")
+	deployCmd.Flags().BoolVar(&privateStaging, "private-staging", false, "restrict the staging URL to IAM authenticated requests (priming requests are signed with your credentials)")
+	addScanGateFlags(deployCmd, &scanGate)
 }
 
 func init() {
@@ -70,7 +77,7 @@ func init() {
 			if !yes {
 				return fmt.Errorf("must pass --yes to actually undeploy the '%s' function", fnName)
 			}
-			if err := undeploy(fnName); err != nil {
+			if err := undeploy(c.Context(), fnName); err != nil {
 				return err
 			}
 			return nil
@@ -79,7 +86,10 @@ func init() {
 	undeployCmd.Flags().BoolVar(&yes, "yes", false, "Actually undeploy the function")
 }
 
-func prepareDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string, version int, alias string) (string, error) {
+// prepareDeploy points the alias to the given version and creates/updates its
+// function URL. The URL auth type is taken from the function spec unless
+// forceIAM is set. Returns the function URL and its auth type.
+func prepareDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string, version int, alias string, forceIAM bool) (string, lambdatypes.FunctionUrlAuthType, error) {
 
 	var err error
 	verStr := strconv.Itoa(version)
@@ -95,7 +105,7 @@ func prepareDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string,
 		return err
 	}); err != nil {
 		if !strings.Contains(err.Error(), "already exists") {
-			return "", fmt.Errorf("failed to create function alias '%s': %s", alias, err)
+			return "", "", fmt.Errorf("failed to create function alias '%s': %s", alias, err)
 		}
 		if err := retryOnResourceConflict(ctx, func() error {
 			_, err := lambdaCl.UpdateAlias(ctx, &lambda.UpdateAliasInput{
@@ -105,7 +115,7 @@ func prepareDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string,
 			})
 			return err
 		}); err != nil {
-			return "", fmt.Errorf("failed to update function alias 'active': %s", err)
+			return "", "", fmt.Errorf("failed to update function alias 'active': %s", err)
 		}
 	}
 
@@ -116,20 +126,15 @@ func prepareDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string,
 		Qualifier:    &alias,
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to get function '%s' alias '%s': %s", fnName, alias, err)
+		return "", "", fmt.Errorf("failed to get function '%s' alias '%s': %s", fnName, alias, err)
 	}
-	env := gfo.Configuration.Environment
-	var cors lambdatypes.Cors
-	if env != nil {
-		if corsStr, ok := env.Variables[specInEnvPrefix+"CORS"]; ok {
-			var c fnspec.CORS
-			if err := json.Unmarshal([]byte(corsStr), &c); err != nil {
-				return "", fmt.Errorf("failed to parse CORS configuration: %s", err)
-			}
-			cors.AllowOrigins = c.Origins
-			cors.AllowMethods = c.Methods
-			cors.AllowHeaders = c.Headers
-		}
+	authType, cors, err := specURLConfig(gfo.Configuration.Environment)
+	if err != nil {
+		return "", "", err
+	}
+
+	if forceIAM {
+		authType = lambdatypes.FunctionUrlAuthTypeAwsIam
 	}
 
 	// Create or update function URL
@@ -138,7 +143,7 @@ func prepareDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string,
 	var cfuc *lambda.CreateFunctionUrlConfigOutput
 	if err := retryOnResourceConflict(ctx, func() error {
 		cfuc, err = lambdaCl.CreateFunctionUrlConfig(ctx, &lambda.CreateFunctionUrlConfigInput{
-			AuthType:     lambdatypes.FunctionUrlAuthTypeNone,
+			AuthType:     authType,
 			FunctionName: &fnName,
 			Qualifier:    &alias,
 			Cors:         &cors,
@@ -146,11 +151,11 @@ func prepareDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string,
 		return err
 	}); err != nil {
 		if !strings.Contains(err.Error(), "exists for this") {
-			return "", fmt.Errorf("failed to create function URL for alias '%s': %s", alias, err)
+			return "", "", fmt.Errorf("failed to create function URL for alias '%s': %s", alias, err)
 		}
 		if err := retryOnResourceConflict(ctx, func() error {
 			ufuc, err := lambdaCl.UpdateFunctionUrlConfig(ctx, &lambda.UpdateFunctionUrlConfigInput{
-				AuthType:     lambdatypes.FunctionUrlAuthTypeNone,
+				AuthType:     authType,
 				FunctionName: &fnName,
 				Qualifier:    &alias,
 				Cors:         &cors,
@@ -158,13 +163,60 @@ func prepareDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string,
 			fnURL = *ufuc.FunctionUrl
 			return err
 		}); err != nil {
-			return "", fmt.Errorf("failed to update function URL for alias '%s': %s", alias, err)
+			return "", "", fmt.Errorf("failed to update function URL for alias '%s': %s", alias, err)
 		}
 	} else {
 		fnURL = *cfuc.FunctionUrl
 	}
 
-	// Add public access permission
+	// Add public access permission for public URLs and remove it otherwise
+
+	if err := setURLPublicAccess(ctx, lambdaCl, fnName, alias, authType); err != nil {
+		return "", "", err
+	}
+
+	return fnURL, authType, nil
+}
+
+// specURLConfig returns the function URL auth type and CORS configuration
+// stored in the given function env by publish.
+func specURLConfig(env *lambdatypes.EnvironmentResponse) (lambdatypes.FunctionUrlAuthType, lambdatypes.Cors, error) {
+	authType := lambdatypes.FunctionUrlAuthTypeNone
+	var cors lambdatypes.Cors
+	if env == nil {
+		return authType, cors, nil
+	}
+	if env.Variables[specInEnvPrefix+"URL_AUTH"] == fnspec.URLAuthIAM {
+		authType = lambdatypes.FunctionUrlAuthTypeAwsIam
+	}
+	if corsStr, ok := env.Variables[specInEnvPrefix+"CORS"]; ok {
+		var c fnspec.CORS
+		if err := json.Unmarshal([]byte(corsStr), &c); err != nil {
+			return authType, cors, fmt.Errorf("failed to parse CORS configuration: %s", err)
+		}
+		cors.AllowOrigins = c.Origins
+		cors.AllowMethods = c.Methods
+		cors.AllowHeaders = c.Headers
+	}
+	return authType, cors, nil
+}
+
+// setURLPublicAccess adds the permission allowing anyone to invoke the function
+// URL of the given alias if its auth type is none and removes it otherwise.
+func setURLPublicAccess(ctx context.Context, lambdaCl *lambda.Client, fnName string, alias string, authType lambdatypes.FunctionUrlAuthType) error {
+	if authType == lambdatypes.FunctionUrlAuthTypeAwsIam {
+		if err := retryOnResourceConflict(ctx, func() error {
+			_, err := lambdaCl.RemovePermission(ctx, &lambda.RemovePermissionInput{
+				StatementId:  aws.String("AllowPublicAccess"),
+				FunctionName: &fnName,
+				Qualifier:    &alias,
+			})
+			return err
+		}); err != nil && apiErrorCode(err) != "ResourceNotFoundException" {
+			return fmt.Errorf("failed to remove public access permission from '%s' alias URL: %s", alias, err)
+		}
+		return nil
+	}
 
 	if err := retryOnResourceConflict(ctx, func() error {
 		_, err := lambdaCl.AddPermission(ctx, &lambda.AddPermissionInput{
@@ -177,10 +229,10 @@ func prepareDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string,
 		})
 		return err
 	}); err != nil && !strings.Contains(err.Error(), "already exists") {
-		return "", fmt.Errorf("failed to add public access permission to '%s' alias URL: %s", alias, err)
+		return fmt.Errorf("failed to add public access permission to '%s' alias URL: %s", alias, err)
 	}
 
-	return fnURL, nil
+	return nil
 }
 
 // enableSQSTrigggers enables or disables all SQS triggers for the given function alias.
@@ -197,10 +249,17 @@ func enableSQSTriggers(ctx context.Context, lambdaCl *lambda.Client, fnName stri
 		lst = append(lst, es.EventSourceMappings...)
 	}
 
+	var sqsMappings []lambdatypes.EventSourceMappingConfiguration
 	for _, em := range lst {
-		if !strings.HasPrefix(*em.EventSourceArn, "arn:aws:sqs:") {
-			continue
+		if strings.HasPrefix(*em.EventSourceArn, "arn:aws:sqs:") {
+			sqsMappings = append(sqsMappings, em)
 		}
+	}
+
+	// Update all triggers and wait for each to be enabled/disabled.
+
+	return parallel(ctx, len(sqsMappings), func(ctx context.Context, i int) error {
+		em := sqsMappings[i]
 		if err := retryOnResourceConflict(ctx, func() error {
 			_, err := lambdaCl.UpdateEventSourceMapping(ctx, &lambda.UpdateEventSourceMappingInput{
 				UUID:    em.UUID,
@@ -210,44 +269,55 @@ func enableSQSTriggers(ctx context.Context, lambdaCl *lambda.Client, fnName stri
 		}); err != nil {
 			return err
 		}
-	}
-
-	// Wait for all triggers to be enabled/disabled.
-
-	for {
-		allAtDesiredState := true
-		for _, em := range lst {
+		for attempt := 1; ; attempt++ {
 			s, err := lambdaCl.GetEventSourceMapping(ctx, &lambda.GetEventSourceMappingInput{
 				UUID: em.UUID,
 			})
 			if err != nil {
 				return err
 			}
-			if enable && *s.State != "Enabled" || !enable && *s.State != "Disabled" {
-				allAtDesiredState = false
-				break
+			if enable && *s.State == "Enabled" || !enable && *s.State == "Disabled" {
+				return nil
+			}
+			if err := sleepCtx(ctx, retryDelay(attempt)); err != nil {
+				return err
 			}
 		}
-		if allAtDesiredState {
-			break
-		}
-		time.Sleep(1 * time.Second)
-	}
-
-	return nil
+	})
 }
 
 // publish publishes the lambda function to AWS and returns the function URL.
-func deploy(fnName string, version int, primeCount int) (string, error) {
-	ctx := context.Background()
+func deploy(ctx context.Context, fnName string, version int, primeCount int, privateStaging bool, scanGate scanGateOptions) (string, error) {
 
 	// Setup clients
 
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to load aws config: %s", err)
 	}
-	lambdaCl := lambda.NewFromConfig(acfg)
+	acfg := clients.config()
+	lambdaCl := clients.lambda()
+
+	// Check the exact image the version runs rather than whatever its tag
+	// points to now.
+
+	var scanBypassedBy string
+	if scanGate.Require {
+		fn, err := lambdaCl.GetFunction(ctx, &lambda.GetFunctionInput{
+			FunctionName: &fnName,
+			Qualifier:    aws.String(strconv.Itoa(version)),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to get function: %s", err)
+		}
+		if fn.Code == nil || fn.Code.ResolvedImageUri == nil {
+			return "", fmt.Errorf("cannot find the image of version %d", version)
+		}
+		scanBypassedBy, err = checkScanGate(ctx, clients, *fn.Code.ResolvedImageUri, scanGate)
+		if err != nil {
+			return "", err
+		}
+	}
 
 	// Prepare preactive deploy:
 	// Once we ensure the function works, we will switch the active alias to point to this version.
@@ -256,10 +326,14 @@ func deploy(fnName string, version int, primeCount int) (string, error) {
 
 	ctxTo, cancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
-	preactiveFnURL, err := prepareDeploy(ctxTo, lambdaCl, fnName, version, preactiveAlias)
+	preactiveFnURL, preactiveAuth, err := prepareDeploy(ctxTo, lambdaCl, fnName, version, preactiveAlias, privateStaging)
 	if err != nil {
 		return "", err
 	}
+	var preactiveSign requestSigner
+	if preactiveAuth == lambdatypes.FunctionUrlAuthTypeAwsIam {
+		preactiveSign = newURLSigner(acfg)
+	}
 
 	log.Print("waiting for function to return non 5xx")
 
@@ -267,13 +341,25 @@ func deploy(fnName string, version int, primeCount int) (string, error) {
 
 	// Run with 1 concurrency first to ensure function doesn't make debugging hard
 	// by producing too many log entries.
-	if err := prime(ctx, preactiveFnURL, 1); err != nil {
+	if _, err := prime(ctx, preactiveFnURL, 1, preactiveSign); err != nil {
 		return "", fmt.Errorf("function failed to return non 5xx - aborting deploy: %s\n\n%s", err, errInst)
 	}
 
-	if err := prime(ctx, preactiveFnURL, primeCount); err != nil {
+	warmed, err := prime(ctx, preactiveFnURL, primeCount, preactiveSign)
+	if err != nil {
 		return "", fmt.Errorf("function failed to return non 5xx - aborting deploy: %s\n\n%s", err, errInst)
 	}
+	if warmed > 0 {
+		log.Printf("warmed up %d sandboxes", warmed)
+	}
+
+	// Guard against the preactive alias silently pointing to another version.
+
+	ctxTo, cancel = context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	if err := waitOnDeploy(ctxTo, lambdaCl, fnName, version, preactiveAlias, preactiveFnURL, preactiveSign); err != nil {
+		return "", fmt.Errorf("staging endpoint is not serving version %d - aborting deploy: %s\n\n%s", version, err, errInst)
+	}
 
 	log.Printf("staging success")
 
@@ -288,7 +374,7 @@ func deploy(fnName string, version int, primeCount int) (string, error) {
 		return "", fmt.Errorf("failed to enable SQS triggers: %s", err)
 	}
 
-	numVer, err := resolveVersion(fnName, activeAlias)
+	numVer, err := resolveVersion(ctx, fnName, activeAlias)
 	if err != nil {
 		if !strings.Contains(err.Error(), "ResourceNotFoundException") {
 			return "", fmt.Errorf("failed to resolve version for alias '%s': %s", activeAlias, err)
@@ -301,8 +387,8 @@ func deploy(fnName string, version int, primeCount int) (string, error) {
 
 	log.Printf("(re-)creating cron triggers for the new version")
 
-	schedCl := scheduler.NewFromConfig(acfg)
-	schedGroupName := fmt.Sprintf("lambdafy-%s", fnName)
+	schedCl := clients.scheduler()
+	schedGroupName := scheduleGroupName(fnName)
 	if _, err := schedCl.DeleteScheduleGroup(ctx, &scheduler.DeleteScheduleGroupInput{
 		Name: &schedGroupName,
 	}); err != nil {
@@ -320,14 +406,18 @@ func deploy(fnName string, version int, primeCount int) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to get function config: %s", err)
 	}
-	crons := make(map[string]string)
+	crons := make(map[string]*fnspec.CronTrigger)
 	env := fnCfg.Configuration.Environment
 	if env != nil {
 		for k, v := range env.Variables {
 			if !strings.HasPrefix(k, specInEnvCronPrefix) {
 				continue
 			}
-			crons[k[len(specInEnvCronPrefix):]] = v
+			c, err := decodeCronEnv(v)
+			if err != nil {
+				return "", fmt.Errorf("failed to parse cron trigger '%s': %s", k, err)
+			}
+			crons[k[len(specInEnvCronPrefix):]] = c
 		}
 	}
 
@@ -344,27 +434,46 @@ func deploy(fnName string, version int, primeCount int) (string, error) {
 		}, "ConflictException"); err != nil {
 			return "", fmt.Errorf("failed to create schedule group: %s", err)
 		}
-		for k, v := range crons {
+		var cronNames []string
+		for k := range crons {
+			cronNames = append(cronNames, k)
+		}
+		if err := parallel(ctx, len(cronNames), func(ctx context.Context, i int) error {
+			k := cronNames[i]
+			v := crons[k]
 			// payload is used by the proxy to extract the name of the cron and pass
 			// it onto the app.
 			payload, _ := json.Marshal(map[string]string{
 				"cron": k,
 			})
-			if _, err := schedCl.CreateSchedule(ctx, &scheduler.CreateScheduleInput{
-				Name:               aws.String(fmt.Sprintf("lambdafy-%s-%s", fnName, k)),
-				GroupName:          &schedGroupName,
-				ScheduleExpression: aws.String(fmt.Sprintf("cron(%s)", v)),
-				Target: &schedulertypes.Target{
-					Arn:     fnCfg.Configuration.FunctionArn,
-					RoleArn: fnCfg.Configuration.Role,
-					Input:   aws.String(string(payload)),
-				},
-				FlexibleTimeWindow: &schedulertypes.FlexibleTimeWindow{
-					Mode: schedulertypes.FlexibleTimeWindowModeOff,
-				},
-			}); err != nil {
-				return "", fmt.Errorf("failed to create schedule: %s", err)
+			state := schedulertypes.ScheduleStateEnabled
+			if !v.IsEnabled() {
+				state = schedulertypes.ScheduleStateDisabled
 			}
+			var desc *string
+			if v.Description != "" {
+				desc = aws.String(v.Description)
+			}
+			return retry(ctx, func() error {
+				_, err := schedCl.CreateSchedule(ctx, &scheduler.CreateScheduleInput{
+					Name:               aws.String(scheduleName(fnName, k)),
+					GroupName:          &schedGroupName,
+					ScheduleExpression: aws.String(fmt.Sprintf("cron(%s)", v.Schedule)),
+					State:              state,
+					Description:        desc,
+					Target: &schedulertypes.Target{
+						Arn:     fnCfg.Configuration.FunctionArn,
+						RoleArn: fnCfg.Configuration.Role,
+						Input:   aws.String(string(payload)),
+					},
+					FlexibleTimeWindow: &schedulertypes.FlexibleTimeWindow{
+						Mode: schedulertypes.FlexibleTimeWindowModeOff,
+					},
+				})
+				return err
+			}, "ThrottlingException")
+		}); err != nil {
+			return "", fmt.Errorf("failed to create schedule: %s", err)
 		}
 	}
 
@@ -372,28 +481,154 @@ func deploy(fnName string, version int, primeCount int) (string, error) {
 
 	ctxTo, cancel = context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
-	activeFnURL, err := prepareDeploy(ctxTo, lambdaCl, fnName, version, activeAlias)
+
+	// Record scan gate bypasses so they can be audited. The function tag keeps
+	// the last bypass even after later deploys whereas the alias description
+	// only shows it while the version is active. Failing to record a bypass
+	// must not leave the deploy half done.
+
+	if scanBypassedBy != "" {
+		if err := tagScanGateBypass(ctxTo, lambdaCl, fnName, version, scanBypassedBy); err != nil {
+			log.Printf("warning: %s", err)
+		}
+	}
+
+	activeFnURL, activeAuth, err := prepareDeploy(ctxTo, lambdaCl, fnName, version, activeAlias, false)
 	if err != nil {
 		return "", err
 	}
+	if err := updateScanGateAliasDesc(ctxTo, lambdaCl, fnName, version, scanBypassedBy); err != nil {
+		log.Printf("warning: %s", err)
+	}
+	var activeSign requestSigner
+	if activeAuth == lambdatypes.FunctionUrlAuthTypeAwsIam {
+		activeSign = newURLSigner(acfg)
+	}
 
 	// Wait for function to stabilize
 
+	log.Printf("waiting for active endpoint to serve the new version")
+
+	ctxTo, cancel = context.WithTimeout(ctx, 3*time.Minute)
+	defer cancel()
+	if err := waitOnDeploy(ctxTo, lambdaCl, fnName, version, activeAlias, activeFnURL, activeSign); err != nil {
+		return "", fmt.Errorf("failed waiting for deploy to propagate: %s", err)
+	}
+
 	return activeFnURL, nil
 }
 
-func undeploy(fnName string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+// functionVersionHeader is the response header set by the proxy to the
+// version of the function that served the request.
+const functionVersionHeader = "X-Lambdafy-Version"
+
+// waitOnDeploy waits until the alias points to the given version, its URL
+// config is in place and the URL consistently serves the given version.
+// Functions with an older proxy that does not set functionVersionHeader are
+// considered to serve the new version as soon as the URL responds.
+func waitOnDeploy(ctx context.Context, lambdaCl *lambda.Client, fnName string, version int, alias string, fnURL string, sign requestSigner) error {
+	verStr := strconv.Itoa(version)
+
+	for {
+		a, err := lambdaCl.GetAlias(ctx, &lambda.GetAliasInput{
+			FunctionName: &fnName,
+			Name:         &alias,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get alias '%s': %s", alias, err)
+		}
+		if *a.FunctionVersion == verStr {
+			break
+		}
+		verbosef("alias '%s' still points to version %s", alias, *a.FunctionVersion)
+		if err := sleepCtx(ctx, time.Second); err != nil {
+			return err
+		}
+	}
+
+	for {
+		u, err := lambdaCl.GetFunctionUrlConfig(ctx, &lambda.GetFunctionUrlConfigInput{
+			FunctionName: &fnName,
+			Qualifier:    &alias,
+		})
+		if err == nil && *u.FunctionUrl == fnURL {
+			break
+		}
+		if err != nil && apiErrorCode(err) != "ResourceNotFoundException" {
+			return fmt.Errorf("failed to get function URL config for alias '%s': %s", alias, err)
+		}
+		if err := sleepCtx(ctx, time.Second); err != nil {
+			return err
+		}
+	}
+
+	// Different sandboxes may serve consecutive requests, so require several
+	// consecutive matches before trusting the result.
+
+	conseqMatches := 0
+	lastServedVer := ""
+	for conseqMatches < 3 {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fnURL, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %s", err)
+		}
+		if sign != nil {
+			if err := sign(req); err != nil {
+				return fmt.Errorf("failed to sign request: %s", err)
+			}
+		}
+		resp, err := urlClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			conseqMatches = 0
+		} else {
+			resp.Body.Close()
+			servedVer := resp.Header.Get(functionVersionHeader)
+			switch {
+			case resp.StatusCode == http.StatusForbidden || resp.StatusCode >= 500:
+				// Public access permission has not propagated yet or the function is
+				// still starting up.
+				conseqMatches = 0
+			case servedVer == "":
+				log.Printf("warning: function does not report its version (lambdafied with an older lambdafy?) - cannot verify '%s' alias is serving version %d", alias, version)
+				return nil
+			case servedVer == verStr:
+				conseqMatches++
+				continue
+			default:
+				verbosef("URL still serving version %s", servedVer)
+				lastServedVer = servedVer
+				conseqMatches = 0
+			}
+		}
+		if err := sleepCtx(ctx, 500*time.Millisecond); err != nil {
+			break
+		}
+	}
+
+	if conseqMatches < 3 {
+		if lastServedVer != "" {
+			return fmt.Errorf("URL '%s' is serving version %s instead of %s", fnURL, lastServedVer, verStr)
+		}
+		return ctx.Err()
+	}
+	return nil
+}
+
+func undeploy(ctx context.Context, fnName string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 	defer cancel()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to load aws config: %s", err)
 	}
-	lambdaCl := lambda.NewFromConfig(acfg)
+	lambdaCl := clients.lambda()
 
 	log.Print("disabling SQS triggers")
 
-	numVer, err := resolveVersion(fnName, activeAlias)
+	numVer, err := resolveVersion(ctx, fnName, activeAlias)
 	if err != nil {
 		if !strings.Contains(err.Error(), "ResourceNotFoundException") {
 			return fmt.Errorf("failed to resolve version for alias '%s': %s", activeAlias, err)
@@ -409,6 +644,9 @@ func undeploy(fnName string) error {
 
 	log.Print("deleting the function url endpoint")
 
+	if err := deleteAliasURL(ctx, lambdaCl, fnName, activeAlias); err != nil {
+		return err
+	}
 	if err := retryOnResourceConflict(ctx, func() error {
 		_, err := lambdaCl.DeleteAlias(ctx, &lambda.DeleteAliasInput{
 			FunctionName: &fnName,
@@ -422,35 +660,110 @@ func undeploy(fnName string) error {
 	return nil
 }
 
-// prime primes the function by sending requests to it.
-func prime(ctx context.Context, url string, num int) error {
+// requestSigner signs HTTP requests to IAM authenticated function URLs.
+type requestSigner func(*http.Request) error
+
+// emptyPayloadHash is the SHA256 hash of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// newURLSigner returns a requestSigner which signs bodyless requests with the
+// credentials of the given config using SigV4.
+func newURLSigner(acfg aws.Config) requestSigner {
+	signer := v4.NewSigner()
+	return func(r *http.Request) error {
+		creds, err := acfg.Credentials.Retrieve(r.Context())
+		if err != nil {
+			return fmt.Errorf("failed to get aws credentials: %s", err)
+		}
+		return signer.SignHTTP(r.Context(), creds, r, emptyPayloadHash, "lambda", acfg.Region, time.Now())
+	}
+}
+
+// instanceIDHeader is the response header set by the proxy to the random
+// identifier of the sandbox that served the request.
+const instanceIDHeader = "X-Lambdafy-Instance"
+
+// maxPrimeRequestsPerInstance caps the number of requests prime sends per
+// instance it's asked to warm up, so a failing function isn't hammered.
+const maxPrimeRequestsPerInstance = 50
+
+// urlClient is used for all requests to function URLs so that connections are
+// reused across priming and checking of deploys.
+var urlClient = &http.Client{
+	Timeout: time.Minute,
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// prime primes the function by sending requests to it until each of num
+// concurrent senders gets 3 consecutive non 5xx responses. Senders back off
+// exponentially on errors and 5xx responses. If sign is not nil, it is used to
+// sign each request. The number of distinct sandboxes that responded is
+// returned, which is 0 for functions with an older proxy that does not set
+// instanceIDHeader.
+func prime(ctx context.Context, url string, num int, sign requestSigner) (int, error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
 	wg := sync.WaitGroup{}
 	wg.Add(num)
 	errCh := make(chan error, num)
 
+	var mu sync.Mutex
+	instances := map[string]struct{}{}
+	var sent int64
+	maxRequests := int64(num * maxPrimeRequestsPerInstance)
+
 	for i := 0; i < num; i++ {
 		go func() {
 			defer wg.Done()
 			conseqSuccess := 0
+			backoff := 250 * time.Millisecond
 			for {
+				if atomic.AddInt64(&sent, 1) > maxRequests {
+					errCh <- fmt.Errorf("gave up after %d requests", maxRequests)
+					return
+				}
 				req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 				if err != nil {
 					errCh <- fmt.Errorf("failed to create request: %s", err)
 					return
 				}
-				resp, err := http.DefaultClient.Do(req)
-				if err == context.Canceled || err == context.DeadlineExceeded {
+				if sign != nil {
+					if err := sign(req); err != nil {
+						errCh <- fmt.Errorf("failed to sign request: %s", err)
+						return
+					}
+				}
+				resp, err := urlClient.Do(req)
+				if ctx.Err() != nil {
 					return
 				}
 				if err == nil {
+					_, _ = io.Copy(io.Discard, resp.Body)
 					resp.Body.Close()
+					if id := resp.Header.Get(instanceIDHeader); id != "" {
+						mu.Lock()
+						instances[id] = struct{}{}
+						mu.Unlock()
+					}
 				}
 				if err != nil || resp.StatusCode < 200 || resp.StatusCode >= 500 {
 					conseqSuccess = 0
-					time.Sleep(500 * time.Millisecond)
+					if err := sleepCtx(ctx, backoff/2+time.Duration(rand.Int63n(int64(backoff)))); err != nil {
+						return
+					}
+					if backoff < 8*time.Second {
+						backoff *= 2
+					}
 					continue
 				}
+				backoff = 250 * time.Millisecond
 				conseqSuccess++
 				if conseqSuccess == 3 {
 					return
@@ -459,17 +772,27 @@ func prime(ctx context.Context, url string, num int) error {
 		}()
 	}
 
+	done := make(chan struct{})
 	go func() {
 		wg.Wait()
-		cancel()
+		close(done)
 	}()
+	var err error
 	select {
-	case err := <-errCh:
-		return err
-	case <-ctx.Done():
-		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("timed out waiting for instances to warm up")
+	case err = <-errCh:
+	case <-done:
+		// Senders may have failed right before the others finished.
+		select {
+		case err = <-errCh:
+		default:
 		}
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out waiting for instances to warm up")
 	}
-	return nil
+	cancel()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return len(instances), err
 }
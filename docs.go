@@ -3,10 +3,13 @@ package main
 import (
 	"embed"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"text/template"
 
 	"github.com/spf13/cobra"
@@ -38,7 +41,7 @@ var exampleRoleCmd = &cobra.Command{
 	Use:   "example-role",
 	Short: "Prints an example IAM role in terraform format to stdout",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		inlinePol, err := serializeRolePolicy(nil)
+		inlinePol, err := serializeRolePolicy(defaultRolePolicyStatements)
 		if err != nil {
 			return err
 		}
@@ -53,40 +56,69 @@ var exampleRoleCmd = &cobra.Command{
 	},
 }
 
-var createSampleProjectCmd = &cobra.Command{
-	Use:   "create-sample-project output-dir",
-	Short: "Creates a sample project in the given directory",
-	Args:  cobra.ExactArgs(1),
-	RunE: func(cmd *cobra.Command, args []string) error {
+// sampleProjectTmplExt is stripped from the names of sample project files when
+// copied. It keeps the Go sample program out of the package graph of lambdafy.
+const sampleProjectTmplExt = ".tmpl"
 
-		outDir := args[0]
+// sampleProjectTemplates are the runtimes sample projects can be created for.
+// Each has a directory under sampleProjectDir holding its Dockerfile and
+// program, which are combined with the files in the common directory.
+var sampleProjectTemplates = []string{"go", "node", "python", "static"}
 
-		// Create the output directory if it doesn't exist
+var createSampleProjectCmd *cobra.Command
 
-		if err := os.MkdirAll(outDir, 0755); err != nil {
-			return fmt.Errorf("failed to create output directory %s: %w", outDir, err)
-		}
+func init() {
+	var tpl string
+	createSampleProjectCmd = &cobra.Command{
+		Use:   "create-sample-project output-dir",
+		Short: "Creates a sample project in the given directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			if !containsString(sampleProjectTemplates, tpl) {
+				return fmt.Errorf("invalid template '%s' - must be one of %s", tpl, strings.Join(sampleProjectTemplates, ", "))
+			}
+
+			outDir := args[0]
 
-		// Copy the files over
+			// Create the output directory if it doesn't exist
 
-		d, _ := sampleProject.ReadDir(sampleProjectDir)
-		for _, f := range d {
-			p := filepath.Join(sampleProjectDir, f.Name())
-			b, _ := sampleProject.ReadFile(p)
-			outPath := filepath.Join(outDir, f.Name())
-			if err := ioutil.WriteFile(outPath, b, 0644); err != nil {
-				return fmt.Errorf("failed to write file %s: %w", outPath, err)
+			if err := os.MkdirAll(outDir, 0755); err != nil {
+				return fmt.Errorf("failed to create output directory %s: %w", outDir, err)
 			}
-		}
 
-		// Make run.sh executable
+			// Copy the files over
+
+			for _, dir := range []string{"common", tpl} {
+				root := path.Join(sampleProjectDir, dir)
+				if err := fs.WalkDir(sampleProject, root, func(p string, d fs.DirEntry, err error) error {
+					if err != nil {
+						return err
+					}
+					outPath := filepath.Join(outDir, filepath.FromSlash(strings.TrimSuffix(strings.TrimPrefix(p, root), sampleProjectTmplExt)))
+					if d.IsDir() {
+						return os.MkdirAll(outPath, 0755)
+					}
+					b, _ := sampleProject.ReadFile(p)
+					if err := ioutil.WriteFile(outPath, b, 0644); err != nil {
+						return fmt.Errorf("failed to write file %s: %w", outPath, err)
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
 
-		if err := os.Chmod(filepath.Join(outDir, "run.sh"), 0755); err != nil {
-			return fmt.Errorf("failed to make run.sh executable: %w", err)
-		}
+			// Make run.sh executable
 
-		log.Printf("Created sample project in '%s'.", outDir)
-		log.Printf("See '%s/run.sh' to get started.", outDir)
-		return nil
-	},
+			if err := os.Chmod(filepath.Join(outDir, "run.sh"), 0755); err != nil {
+				return fmt.Errorf("failed to make run.sh executable: %w", err)
+			}
+
+			log.Printf("Created %s sample project in '%s'.", tpl, outDir)
+			log.Printf("See '%s/run.sh' to get started.", outDir)
+			return nil
+		},
+	}
+	createSampleProjectCmd.Flags().StringVar(&tpl, "template", "python", "runtime of the sample project: "+strings.Join(sampleProjectTemplates, ", "))
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/mathspace/lambdafy/fnspec"
+)
+
+// egressServices returns the AWS services (as in VPC endpoint service names)
+// the function needs to reach from within the VPC.
+func egressServices(spec *fnspec.Spec) []string {
+	services := []string{"logs"}
+	if len(envRefs(spec.Env, sqsSendStarenvTag)) > 0 {
+		services = append(services, "sqs")
+	}
+	if len(envRefs(spec.Env, "ssm", "pssm")) > 0 {
+		services = append(services, "ssm")
+	}
+	if len(envRefs(spec.Env, "s3")) > 0 {
+		services = append(services, "s3")
+	}
+	return services
+}
+
+// checkEgress returns the reasons the function with the given spec may not be
+// able to reach the AWS services it needs from within its VPC: security groups
+// which do not allow HTTPS out and subnets with neither a route to a NAT nor
+// VPC endpoints for the services. Failed lookups are returned as problems
+// too, as the checks depending on them cannot be done. It returns an error if
+// the security groups allow no egress at all.
+func checkEgress(ctx context.Context, ec2Cl *ec2.Client, spec *fnspec.Spec, region string) ([]string, error) {
+	var problems []string
+
+	// Security groups
+
+	sgs, err := ec2Cl.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
+		GroupIds: spec.VPCSecurityGroupIds,
+	})
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("failed to lookup security groups to check their egress rules: %s", err))
+	} else {
+		hasEgress := false
+		hasHTTPSEgress := false
+		for _, sg := range sgs.SecurityGroups {
+			for _, rule := range sg.IpPermissionsEgress {
+				hasEgress = true
+				proto := aws.ToString(rule.IpProtocol)
+				if proto == "-1" || (proto == "tcp" && aws.ToInt32(rule.FromPort) <= 443 && aws.ToInt32(rule.ToPort) >= 443) {
+					hasHTTPSEgress = true
+				}
+			}
+		}
+		if !hasEgress {
+			return nil, fmt.Errorf("VPC config is set in your spec, but no outbound/egress rules specified")
+		}
+		if !hasHTTPSEgress {
+			problems = append(problems, "no outbound/egress rules of the security groups allow HTTPS traffic - you need this to be able to send logs to Cloudwatch")
+		}
+	}
+
+	// Routes and VPC endpoints of subnets
+
+	subnets, err := ec2Cl.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		SubnetIds: spec.VPCSubnetIds,
+	})
+	if err != nil {
+		return append(problems, fmt.Sprintf("failed to lookup subnets to check their routes and VPC endpoints: %s", err)), nil
+	}
+	var vpcIDs []string
+	for _, s := range subnets.Subnets {
+		if !containsString(vpcIDs, *s.VpcId) {
+			vpcIDs = append(vpcIDs, *s.VpcId)
+		}
+	}
+	if len(vpcIDs) == 0 {
+		return problems, nil
+	}
+	vpcFilter := []ec2types.Filter{{Name: aws.String("vpc-id"), Values: vpcIDs}}
+
+	subnetTables := map[string]ec2types.RouteTable{}
+	mainTables := map[string]ec2types.RouteTable{}
+	rtPages := ec2.NewDescribeRouteTablesPaginator(ec2Cl, &ec2.DescribeRouteTablesInput{Filters: vpcFilter})
+	for rtPages.HasMorePages() {
+		p, err := rtPages.NextPage(ctx)
+		if err != nil {
+			return append(problems, fmt.Sprintf("failed to lookup route tables to check the routes of subnets: %s", err)), nil
+		}
+		for _, rt := range p.RouteTables {
+			for _, a := range rt.Associations {
+				if aws.ToBool(a.Main) {
+					mainTables[*rt.VpcId] = rt
+				} else if a.SubnetId != nil {
+					subnetTables[*a.SubnetId] = rt
+				}
+			}
+		}
+	}
+
+	// Endpoints are keyed by the short service name (e.g. logs).
+	endpoints := map[string][]ec2types.VpcEndpoint{}
+	epPages := ec2.NewDescribeVpcEndpointsPaginator(ec2Cl, &ec2.DescribeVpcEndpointsInput{Filters: vpcFilter})
+	for epPages.HasMorePages() {
+		p, err := epPages.NextPage(ctx)
+		if err != nil {
+			return append(problems, fmt.Sprintf("failed to lookup VPC endpoints to check the routes of subnets: %s", err)), nil
+		}
+		for _, ep := range p.VpcEndpoints {
+			if !strings.EqualFold(string(ep.State), "available") {
+				continue
+			}
+			svc := strings.TrimPrefix(aws.ToString(ep.ServiceName), "com.amazonaws."+region+".")
+			endpoints[svc] = append(endpoints[svc], ep)
+		}
+	}
+
+	services := egressServices(spec)
+	for _, s := range subnets.Subnets {
+		rt, ok := subnetTables[*s.SubnetId]
+		if !ok {
+			rt = mainTables[*s.VpcId]
+		}
+
+		// Functions never get public IPs so routes to internet gateways are of no
+		// use to them.
+
+		viaNAT := false
+		viaIGW := false
+		for _, r := range rt.Routes {
+			if aws.ToString(r.DestinationCidrBlock) != "0.0.0.0/0" || r.State != ec2types.RouteStateActive {
+				continue
+			}
+			if strings.HasPrefix(aws.ToString(r.GatewayId), "igw-") {
+				viaIGW = true
+			}
+			if r.NatGatewayId != nil || r.TransitGatewayId != nil || r.InstanceId != nil || r.NetworkInterfaceId != nil || r.VpcPeeringConnectionId != nil {
+				viaNAT = true
+			}
+		}
+		if viaNAT {
+			continue
+		}
+
+		var unreachable []string
+		for _, svc := range services {
+			reachable := false
+			for _, ep := range endpoints[svc] {
+				if *ep.VpcId != *s.VpcId {
+					continue
+				}
+				if ep.VpcEndpointType == ec2types.VpcEndpointTypeGateway {
+					reachable = reachable || (rt.RouteTableId != nil && containsString(ep.RouteTableIds, *rt.RouteTableId))
+				} else {
+					reachable = true
+				}
+			}
+			if !reachable {
+				unreachable = append(unreachable, svc)
+			}
+		}
+		if len(unreachable) == 0 {
+			continue
+		}
+		sort.Strings(unreachable)
+		p := fmt.Sprintf("subnet %s has no route to a NAT and no VPC endpoints for %s", *s.SubnetId, strings.Join(unreachable, ", "))
+		if viaIGW {
+			p += " - its route to an internet gateway cannot be used by lambda functions"
+		}
+		problems = append(problems, p)
+	}
+
+	return problems, nil
+}
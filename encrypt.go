@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/spf13/cobra"
+
+	"github.com/mathspace/lambdafy/fnspec"
+)
+
+var encryptCmd *cobra.Command
+
+func init() {
+	var kmsKey string
+	var ageRecipients []string
+	encryptCmd = &cobra.Command{
+		Use:   "encrypt",
+		Short: "Encrypt a value read from stdin for use in spec env",
+		Long: `Encrypt a value read from stdin for use in spec env. Exactly one of --kms-key
+and --age-recipient must be specified. A single trailing newline is removed from
+the value. The encrypted value is printed to stdout in the form ENC[kms:...] or
+ENC[age:...] and is decrypted when publishing.`,
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			if (kmsKey == "") == (len(ageRecipients) == 0) {
+				return errors.New("exactly one of --kms-key and --age-recipient must be specified")
+			}
+			v, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return fmt.Errorf("failed to read value: %s", err)
+			}
+			v = bytes.TrimSuffix(v, []byte("\n"))
+
+			var enc string
+			if kmsKey != "" {
+				enc, err = encryptKMS(c.Context(), kmsKey, v)
+			} else {
+				enc, err = encryptAge(ageRecipients, v)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Println(enc)
+			return nil
+		},
+	}
+	encryptCmd.Flags().StringVar(&kmsKey, "kms-key", "", "ID, alias or ARN of the KMS key to encrypt with")
+	encryptCmd.Flags().StringArrayVar(&ageRecipients, "age-recipient", nil, "age public key to encrypt to - can be specified multiple times")
+}
+
+// encryptedValuePat matches encrypted spec values and captures the scheme and
+// the base64 encoded ciphertext.
+var encryptedValuePat = regexp.MustCompile(`^ENC\[(kms|age):([A-Za-z0-9+/=]+)\]$`)
+
+// encryptKMS encrypts the value with the given KMS key.
+func encryptKMS(ctx context.Context, keyID string, v []byte) (string, error) {
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to load aws config: %s", err)
+	}
+	out, err := clients.kms().Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     &keyID,
+		Plaintext: v,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt with KMS: %s", err)
+	}
+	return "ENC[kms:" + base64.StdEncoding.EncodeToString(out.CiphertextBlob) + "]", nil
+}
+
+// encryptAge encrypts the value to the given age recipients.
+func encryptAge(recipients []string, v []byte) (string, error) {
+	var rs []age.Recipient
+	for _, r := range recipients {
+		ar, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return "", fmt.Errorf("invalid age recipient '%s': %s", r, err)
+		}
+		rs = append(rs, ar)
+	}
+	b := bytes.Buffer{}
+	w, err := age.Encrypt(&b, rs...)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt with age: %s", err)
+	}
+	if _, err := w.Write(v); err != nil {
+		return "", fmt.Errorf("failed to encrypt with age: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt with age: %s", err)
+	}
+	return "ENC[age:" + base64.StdEncoding.EncodeToString(b.Bytes()) + "]", nil
+}
+
+// decryptSpecEnv replaces the encrypted env values of the spec with their
+// decrypted form. age encrypted values are decrypted with the identities in
+// the given files, or the file in SOPS_AGE_KEY_FILE env var if none are given.
+func decryptSpecEnv(ctx context.Context, spec *fnspec.Spec, ageIdentityFiles []string) error {
+	var kmsCl *kms.Client
+	var ageIdentities []age.Identity
+
+	for k, v := range spec.Env {
+		m := encryptedValuePat.FindStringSubmatch(v)
+		if m == nil {
+			continue
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(m[2])
+		if err != nil {
+			return fmt.Errorf("invalid encrypted value of env var '%s': %s", k, err)
+		}
+
+		switch m[1] {
+		case "kms":
+			if kmsCl == nil {
+				clients, err := awsClientsFrom(ctx)
+				if err != nil {
+					return fmt.Errorf("failed to load aws config: %s", err)
+				}
+				kmsCl = clients.kms()
+			}
+			out, err := kmsCl.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: ciphertext})
+			if err != nil {
+				return fmt.Errorf("failed to decrypt env var '%s' with KMS: %s", k, err)
+			}
+			spec.Env[k] = string(out.Plaintext)
+
+		case "age":
+			if ageIdentities == nil {
+				if ageIdentities, err = loadAgeIdentities(ageIdentityFiles); err != nil {
+					return err
+				}
+			}
+			r, err := age.Decrypt(bytes.NewReader(ciphertext), ageIdentities...)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt env var '%s' with age: %s", k, err)
+			}
+			pt, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt env var '%s' with age: %s", k, err)
+			}
+			spec.Env[k] = string(pt)
+		}
+	}
+	return nil
+}
+
+// loadAgeIdentities loads the age identities from the given files, or the file
+// in SOPS_AGE_KEY_FILE env var if none are given.
+func loadAgeIdentities(files []string) ([]age.Identity, error) {
+	if len(files) == 0 {
+		if f := os.Getenv("SOPS_AGE_KEY_FILE"); f != "" {
+			files = []string{f}
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("age identity is needed to decrypt spec values - pass --age-identity or set SOPS_AGE_KEY_FILE")
+	}
+	var ids []age.Identity
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read age identity file: %s", err)
+		}
+		fids, err := age.ParseIdentities(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse age identity file '%s': %s", f, err)
+		}
+		ids = append(ids, fids...)
+	}
+	return ids, nil
+}
@@ -2,10 +2,15 @@
 package fnspec
 
 import (
-	"errors"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/gobwas/glob"
@@ -16,7 +21,52 @@ import (
 // generated.
 const RoleGenerate = "generate"
 
-var ecrRepoPat = regexp.MustCompile(`^\d+\.dkr\.ecr\.[^.]+\.amazonaws\.com/`)
+// Supported values of url_auth.
+const (
+	// URLAuthNone makes function URLs public.
+	URLAuthNone = "none"
+	// URLAuthIAM restricts function URLs to signed requests from IAM principals
+	// allowed to invoke the function URL.
+	URLAuthIAM = "iam"
+)
+
+var (
+	ecrRepoPat  = regexp.MustCompile(`^\d+\.dkr\.ecr\.[^.]+\.amazonaws\.com/`)
+	fnNamePat   = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	repoNamePat = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+	imageTagPat = regexp.MustCompile(`:([^:/@]+)(?:@.*)?$`)
+	rolePathPat = regexp.MustCompile(`^/(?:[\x21-\x7e]*/)?$`)
+	roleNamePat = regexp.MustCompile(`^[\w+=,.@-]*$`)
+)
+
+// MaxEnvSize is the maximum total size of env var names and values lambda
+// allows for a function.
+const MaxEnvSize = 4096
+
+// EnvSize returns the size of the env vars as counted towards MaxEnvSize.
+func EnvSize(env map[string]string) int {
+	n := 0
+	for k, v := range env {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// ValidationError lists all the problems found in a spec.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) add(format string, v ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, v...))
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("%d problems found:\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
 
 // EFSMount represents an AWS Elastic Filesystem mount.
 type EFSMount struct {
@@ -24,11 +74,40 @@ type EFSMount struct {
 	Path string `yaml:"path"` // Path to mount the EFS filesystem at.
 }
 
+// Supported values of egress_check.
+const (
+	// EgressCheckError fails publishing if the function may not be able to
+	// reach the AWS services it needs from within its VPC.
+	EgressCheckError = "error"
+	// EgressCheckWarn only logs warnings for such problems. This is the
+	// default.
+	EgressCheckWarn = "warn"
+	// EgressCheckOff skips checking.
+	EgressCheckOff = "off"
+)
+
+// Supported values of role_policy_mode.
+const (
+	// RolePolicyScoped limits the generated role to the resources the function
+	// is known to need.
+	RolePolicyScoped = "scoped"
+	// RolePolicyPermissive grants the generated role access to all resources
+	// that any function may need.
+	RolePolicyPermissive = "permissive"
+)
+
+// GeneratedSidPrefix is the prefix of the Sid of the role policy statements
+// generated by lambdafy.
+const GeneratedSidPrefix = "Lambdafy"
+
 // RolePolicy represents a policy for a lambda function's IAM role.
 type RolePolicy struct {
+	Sid      string   `yaml:"sid,omitempty" json:"Sid,omitempty"`
 	Effect   string   `yaml:"effect" json:"Effect"`
 	Action   []string `yaml:"action" json:"Action"`
 	Resource []string `yaml:"resource" json:"Resource"`
+	// Condition maps condition operators to condition keys and their values.
+	Condition map[string]map[string]interface{} `yaml:"condition,omitempty" json:"Condition,omitempty"`
 }
 
 // SQSTrigger represents an SQS trigger for a lambda function.
@@ -39,6 +118,53 @@ type SQSTrigger struct {
 	Concurrency *int32 `yaml:"concurrency,omitempty"`
 }
 
+// InvokePermission grants a principal (e.g. s3.amazonaws.com or an account ID)
+// permission to invoke a lambda function, optionally only on behalf of a source
+// resource or account, and only through a qualifier (alias).
+type InvokePermission struct {
+	Principal     string `yaml:"principal" json:"principal"`
+	SourceARN     string `yaml:"source_arn,omitempty" json:"source_arn,omitempty"`
+	SourceAccount string `yaml:"source_account,omitempty" json:"source_account,omitempty"`
+	Action        string `yaml:"action,omitempty" json:"action,omitempty"`
+	Qualifier     string `yaml:"qualifier,omitempty" json:"qualifier,omitempty"`
+}
+
+// DefaultInvokeAction is the action of invoke permissions which do not specify
+// one.
+const DefaultInvokeAction = "lambda:InvokeFunction"
+
+// CronTrigger represents a cron trigger for a lambda function. It can be
+// specified as just the cron expression if no other fields are needed.
+type CronTrigger struct {
+	Schedule    string `yaml:"schedule" json:"schedule"`
+	Enabled     *bool  `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+}
+
+// IsEnabled returns true unless the trigger is explicitly disabled.
+func (c *CronTrigger) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// UnmarshalYAML allows the trigger to be specified as a cron expression.
+func (c *CronTrigger) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&c.Schedule)
+	}
+	type plain CronTrigger
+	return n.Decode((*plain)(c))
+}
+
+// MarshalYAML serializes the trigger as a cron expression if no other fields
+// are set.
+func (c CronTrigger) MarshalYAML() (interface{}, error) {
+	if c.Enabled == nil && c.Description == "" {
+		return c.Schedule, nil
+	}
+	type plain CronTrigger
+	return plain(c), nil
+}
+
 // CORS represents the CORS configuration for a lambda function.
 type CORS struct {
 	Origins []string `yaml:"origins,omitempty" json:"origins,omitempty"`
@@ -46,31 +172,43 @@ type CORS struct {
 	Headers []string `yaml:"headers,omitempty" json:"headers,omitempty"`
 }
 
-// Spec is the specification of a lambda function.
+// Spec is the specification of a lambda function. Fields are serialized in
+// the order they are declared here which follows the order of the example
+// spec. Map keys are serialized in sorted order.
 type Spec struct {
-	Name                  string            `yaml:"name"`
-	Description           string            `yaml:"description,omitempty"`
-	Image                 string            `yaml:"image"`
-	Role                  string            `yaml:"role"`
-	RoleExtraPolicy       []*RolePolicy     `yaml:"role_extra_policy,omitempty"`
-	CreateRepo            *bool             `yaml:"create_repo,omitempty"`
-	RepoName              string            `yaml:"repo_name,omitempty"`
-	Env                   map[string]string `yaml:"env,omitempty"`
-	Entrypoint            []string          `yaml:"entrypoint,omitempty"`
-	Command               []string          `yaml:"command,omitempty"`
-	WorkDir               *string           `yaml:"workdir,omitempty"`
-	Memory                *int32            `yaml:"memory,omitempty"`
-	Timeout               *int32            `yaml:"timeout,omitempty"`
-	Tags                  map[string]string `yaml:"tags,omitempty"`
-	VPCSecurityGroupIds   []string          `yaml:"vpc_security_group_ids,omitempty"`
-	VPCSubnetIds          []string          `yaml:"vpc_subnet_ids,omitempty"`
-	EFSMounts             []*EFSMount       `yaml:"efs_mounts,omitempty"`
-	TempSize              *int32            `yaml:"temp_size,omitempty"`
-	CORS                  CORS              `yaml:"cors,omitempty"`
-	SQSTriggers           []*SQSTrigger     `yaml:"sqs_triggers,omitempty"`
-	CronTriggers          map[string]string `yaml:"cron,omitempty"`
-	AllowedAccountRegions []string          `yaml:"allowed_account_regions,omitempty"`
-	allowedGlobs          []glob.Glob       `yaml:"-"`
+	Name                  string                  `yaml:"name"`
+	Description           string                  `yaml:"description,omitempty"`
+	Image                 string                  `yaml:"image"`
+	RequireDigest         bool                    `yaml:"require_digest,omitempty"`
+	CreateRepo            *bool                   `yaml:"create_repo,omitempty"`
+	RepoName              string                  `yaml:"repo_name,omitempty"`
+	RepoKMSKey            string                  `yaml:"repo_kms_key,omitempty"`
+	RepoImmutableTags     bool                    `yaml:"repo_immutable_tags,omitempty"`
+	Role                  string                  `yaml:"role"`
+	RolePolicyMode        string                  `yaml:"role_policy_mode,omitempty"`
+	RolePath              string                  `yaml:"role_path,omitempty"`
+	RoleNamePrefix        string                  `yaml:"role_name_prefix,omitempty"`
+	RoleTags              map[string]string       `yaml:"role_tags,omitempty"`
+	RoleExtraPolicy       []*RolePolicy           `yaml:"role_extra_policy,omitempty"`
+	Env                   map[string]string       `yaml:"env,omitempty"`
+	Entrypoint            []string                `yaml:"entrypoint,omitempty"`
+	Command               []string                `yaml:"command,omitempty"`
+	WorkDir               *string                 `yaml:"workdir,omitempty"`
+	Memory                *int32                  `yaml:"memory,omitempty"`
+	Timeout               *int32                  `yaml:"timeout,omitempty"`
+	Tags                  map[string]string       `yaml:"tags,omitempty"`
+	TempSize              *int32                  `yaml:"temp_size,omitempty"`
+	EFSMounts             []*EFSMount             `yaml:"efs_mounts,omitempty"`
+	VPCSecurityGroupIds   []string                `yaml:"vpc_security_group_ids,omitempty"`
+	VPCSubnetIds          []string                `yaml:"vpc_subnet_ids,omitempty"`
+	EgressCheck           string                  `yaml:"egress_check,omitempty"`
+	URLAuth               string                  `yaml:"url_auth,omitempty"`
+	CORS                  CORS                    `yaml:"cors,omitempty"`
+	SQSTriggers           []*SQSTrigger           `yaml:"sqs_triggers,omitempty"`
+	InvokePermissions     []*InvokePermission     `yaml:"invoke_permissions,omitempty"`
+	CronTriggers          map[string]*CronTrigger `yaml:"cron,omitempty"`
+	AllowedAccountRegions []string                `yaml:"allowed_account_regions,omitempty"`
+	allowedGlobs          []glob.Glob             `yaml:"-"`
 }
 
 // IsAccountRegionAllowed returns true if the given account and region are
@@ -116,38 +254,86 @@ func Load(r io.Reader, vars map[string]string) (*Spec, error) {
 	if err := dec.Decode(&s); err != nil {
 		return nil, err
 	}
+
+	// Collect all the problems with the spec rather than stopping at the first
+	// so they can be fixed in one go.
+
+	var errs ValidationError
+
 	if s.Name == "" || s.Image == "" || s.Role == "" {
-		return nil, errors.New("name, image and role must be specified")
+		errs.add("name, image and role must be specified")
+	}
+	if s.Name != "" && (len(s.Name) > 64 || !fnNamePat.MatchString(s.Name)) {
+		errs.add("name must be at most 64 characters of a-z, A-Z, 0-9, - and _")
+	}
+	if len(s.Description) > 256 {
+		errs.add("description must be at most 256 characters")
 	}
 	if len(s.RoleExtraPolicy) > 0 && s.Role != RoleGenerate {
-		return nil, errors.New("role_extra_policy can only be used with role: generate")
+		errs.add("role_extra_policy can only be used with role: generate")
 	}
 	for _, p := range s.RoleExtraPolicy {
 		if p.Effect == "" || len(p.Action) == 0 || len(p.Resource) == 0 {
-			return nil, errors.New("role_extra_policy items must have effect, action and resource")
+			errs.add("role_extra_policy items must have effect, action and resource")
+			break
+		}
+	}
+	for _, p := range s.RoleExtraPolicy {
+		if strings.HasPrefix(p.Sid, GeneratedSidPrefix) {
+			errs.add("role_extra_policy sid must not start with '%s'", GeneratedSidPrefix)
+			break
+		}
+	}
+	if s.RolePolicyMode != "" && s.Role != RoleGenerate {
+		errs.add("role_policy_mode can only be used with role: generate")
+	}
+	if s.RolePolicyMode != "" && s.RolePolicyMode != RolePolicyScoped && s.RolePolicyMode != RolePolicyPermissive {
+		errs.add("role_policy_mode must be either '%s' or '%s'", RolePolicyScoped, RolePolicyPermissive)
+	}
+	if (s.RolePath != "" || s.RoleNamePrefix != "" || len(s.RoleTags) > 0) && s.Role != RoleGenerate {
+		errs.add("role_path, role_name_prefix and role_tags can only be used with role: generate")
+	}
+	if s.RolePath != "" && (len(s.RolePath) > 512 || !rolePathPat.MatchString(s.RolePath)) {
+		errs.add("role_path must be at most 512 characters, starting and ending with /")
+	}
+	// Generated role names are the prefix followed by 44 characters and are
+	// limited to 64 characters.
+	if len(s.RoleNamePrefix) > 20 || !roleNamePat.MatchString(s.RoleNamePrefix) {
+		errs.add("role_name_prefix must be at most 20 characters of a-z, A-Z, 0-9 and +=,.@_-")
+	}
+	if len(s.RoleTags) > 50 {
+		errs.add("at most 50 role_tags are allowed")
+	}
+	for k, v := range s.RoleTags {
+		if k == "" || len(k) > 128 || strings.HasPrefix(strings.ToLower(k), "aws:") {
+			errs.add("role tag key '%s' must be 1 to 128 characters and not start with 'aws:'", k)
+		}
+		if len(v) > 256 {
+			errs.add("role tag value for '%s' must be at most 256 characters", k)
 		}
 	}
 	if s.Memory != nil && (*s.Memory < 128 || *s.Memory > 10240) {
-		return nil, errors.New("memory must be between 128 and 10240 MB")
+		errs.add("memory must be between 128 and 10240 MB")
 	}
 	if s.Timeout != nil && (*s.Timeout < 3 || *s.Timeout > 900) {
-		return nil, errors.New("timeout spec must be between 3 and 900")
+		errs.add("timeout spec must be between 3 and 900")
 	}
 	if s.TempSize != nil && (*s.TempSize < 512 || *s.TempSize > 10240) {
-		return nil, errors.New("temp_size spec must be between 512 and 10240")
+		errs.add("temp_size spec must be between 512 and 10240")
 	}
 
 	for _, a := range s.AllowedAccountRegions {
 		g, err := glob.Compile(a, ':')
 		if err != nil {
-			return nil, errors.New("invalid allowed_account_regions pattern")
+			errs.add("invalid allowed_account_regions pattern '%s'", a)
+			continue
 		}
 		s.allowedGlobs = append(s.allowedGlobs, g)
 	}
 
 	if ecrRepoPat.MatchString(s.Image) {
-		if s.RepoName != "" || s.CreateRepo != nil {
-			return nil, errors.New("repo_name and create_repo can only be used with non-ECR docker images")
+		if s.RepoName != "" || s.CreateRepo != nil || s.RepoKMSKey != "" || s.RepoImmutableTags {
+			errs.add("repo_name, create_repo, repo_kms_key and repo_immutable_tags can only be used with non-ECR docker images")
 		}
 	} else {
 		t := true
@@ -157,28 +343,68 @@ func Load(r io.Reader, vars map[string]string) (*Spec, error) {
 		if s.RepoName == "" {
 			s.RepoName = s.Name
 		}
+		if len(s.RepoName) < 2 || len(s.RepoName) > 256 || !repoNamePat.MatchString(s.RepoName) {
+			errs.add("repo_name must be 2 to 256 characters of a-z, 0-9, ., _, - and /")
+		}
+	}
+	// Non-ECR images are pinned to the digest they are pushed with.
+	if s.RequireDigest && ecrRepoPat.MatchString(s.Image) && !strings.Contains(s.Image, "@sha256:") {
+		errs.add("image must be pinned to a digest (e.g. repo@sha256:...) when require_digest is set")
+	}
+	// Docker limits image names (i.e. without tag or digest) to 255 characters.
+	imgName := s.Image
+	if i := strings.Index(imgName, "@"); i >= 0 {
+		imgName = imgName[:i]
+	}
+	if m := imageTagPat.FindStringSubmatch(s.Image); m != nil {
+		if len(m[1]) > 128 {
+			errs.add("image tag must be at most 128 characters")
+		}
+		imgName = strings.TrimSuffix(imgName, ":"+m[1])
+	}
+	if len(imgName) > 255 {
+		errs.add("image URI must be at most 255 characters excluding the tag and digest")
 	}
 
 	for _, s := range s.SQSTriggers {
 		if s.ARN == "" {
-			return nil, errors.New("sqs_event_sources must have an arn")
+			errs.add("sqs_event_sources must have an arn")
 		}
 		if s.BatchSize == nil {
 			bs := int32(1)
 			s.BatchSize = &bs
 		}
 		if *s.BatchSize < 1 || *s.BatchSize > 10000 {
-			return nil, errors.New("sqs_event_sources max_batch_size must be between 1 and 10000")
+			errs.add("sqs_event_sources max_batch_size must be between 1 and 10000")
 		}
 		if s.BatchWindow != nil && (*s.BatchWindow < 0 || *s.BatchWindow > 300) {
-			return nil, errors.New("sqs_event_sources batch_window must be between 0 and 300")
+			errs.add("sqs_event_sources batch_window must be between 0 and 300")
 		}
 		if *s.BatchSize >= 10 && s.BatchWindow == nil {
 			bw := int32(1)
 			s.BatchWindow = &bw
 		}
 		if s.Concurrency != nil && (*s.Concurrency < 2 || *s.Concurrency > 1000) {
-			return nil, errors.New("sqs_event_sources max_concurrency must be between 2 and 1000")
+			errs.add("sqs_event_sources max_concurrency must be between 2 and 1000")
+		}
+	}
+
+	accountIDPat := regexp.MustCompile(`^\d{12}$`)
+	// Only aliases are allowed as qualifiers as permissions on versions can't be
+	// found, and hence removed, once they are no longer in the spec.
+	aliasPat := regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*$`)
+	for _, p := range s.InvokePermissions {
+		if p.Principal == "" {
+			errs.add("invoke_permissions must have a principal")
+		}
+		if p.SourceAccount != "" && !accountIDPat.MatchString(p.SourceAccount) {
+			errs.add("invoke_permissions source_account must be a 12 digit account ID")
+		}
+		if p.Action != "" && !strings.HasPrefix(p.Action, "lambda:") {
+			errs.add("invoke_permissions action must start with 'lambda:'")
+		}
+		if p.Qualifier != "" && !aliasPat.MatchString(p.Qualifier) {
+			errs.add("invoke_permissions qualifier '%s' must be an alias name", p.Qualifier)
 		}
 	}
 
@@ -187,13 +413,55 @@ func Load(r io.Reader, vars map[string]string) (*Spec, error) {
 	cronNameCharPat := regexp.MustCompile(`^[a-z0-9](?:[a-z0-9_]*[a-z0-9])?$`)
 	for k, v := range s.CronTriggers {
 		if !cronNameCharPat.MatchString(k) {
-			return nil, errors.New("cron expression name can only have a-z, 0-9 and underscore")
+			errs.add("cron expression name '%s' can only have a-z, 0-9 and underscore", k)
+		}
+		// Schedules are named lambdafy-<name>-<cron name> and are limited to 64
+		// characters.
+		if len(s.Name)+len(k) > 64-len("lambdafy--") {
+			errs.add("cron expression name '%s' is too long for function name '%s'", k, s.Name)
 		}
-		v = strings.TrimSpace(v)
-		if !cronValCharPat.MatchString(v) {
-			return nil, errors.New("invalid cron expression for" + k)
+		if v == nil {
+			errs.add("missing cron expression for %s", k)
+			continue
+		}
+		v.Schedule = strings.TrimSpace(v.Schedule)
+		if !cronValCharPat.MatchString(v.Schedule) {
+			errs.add("invalid cron expression for %s", k)
+		}
+		if len(v.Description) > 512 {
+			errs.add("cron description must be at most 512 characters for %s", k)
 		}
-		s.CronTriggers[k] = v
+	}
+
+	tagCount := len(s.Tags)
+	if _, ok := s.Tags["Name"]; !ok {
+		tagCount++ // Name tag is added by default.
+	}
+	// Lambda allows 50 tags, one of which is reserved for recording scan gate
+	// bypasses.
+	if tagCount > 49 {
+		errs.add("at most 49 tags (including the default Name tag) are allowed")
+	}
+	for k, v := range s.Tags {
+		if k == "" || len(k) > 128 || strings.HasPrefix(strings.ToLower(k), "aws:") {
+			errs.add("tag key '%s' must be 1 to 128 characters and not start with 'aws:'", k)
+		}
+		if len(v) > 256 {
+			errs.add("tag value for '%s' must be at most 256 characters", k)
+		}
+	}
+
+	// Encrypted values are much larger than what they decrypt to, so only their
+	// names are counted here. Publish checks the size again once decrypted.
+	plainEnv := make(map[string]string, len(s.Env))
+	for k, v := range s.Env {
+		if strings.HasPrefix(v, "ENC[") {
+			v = ""
+		}
+		plainEnv[k] = v
+	}
+	if n := EnvSize(plainEnv); n > MaxEnvSize {
+		errs.add("env must be at most %d bytes in total but is %d bytes", MaxEnvSize, n)
 	}
 
 	if !strings.Contains(s.Image, ":") {
@@ -213,14 +481,182 @@ func Load(r io.Reader, vars map[string]string) (*Spec, error) {
 	if s.CORS.Origins == nil {
 		s.CORS.Origins = []string{}
 	}
+	if s.EgressCheck != "" && len(s.VPCSubnetIds) == 0 && len(s.VPCSecurityGroupIds) == 0 {
+		errs.add("egress_check can only be used with VPC config")
+	}
+	if s.EgressCheck != "" && s.EgressCheck != EgressCheckError && s.EgressCheck != EgressCheckWarn && s.EgressCheck != EgressCheckOff {
+		errs.add("egress_check must be one of '%s', '%s' or '%s'", EgressCheckError, EgressCheckWarn, EgressCheckOff)
+	}
+	if s.URLAuth == "" {
+		s.URLAuth = URLAuthNone
+	}
+	if s.URLAuth != URLAuthNone && s.URLAuth != URLAuthIAM {
+		errs.add("url_auth must be either '%s' or '%s'", URLAuthNone, URLAuthIAM)
+	}
+
 	if len(s.CORS.Origins) == 0 && (len(s.CORS.Headers) > 0 || len(s.CORS.Methods) > 0) {
-		return nil, errors.New("cors.allowed_origins must be specified if cors.allowed_headers or cors.allowed_methods are specified")
+		errs.add("cors.allowed_origins must be specified if cors.allowed_headers or cors.allowed_methods are specified")
+	}
+
+	if len(errs.Problems) > 0 {
+		sort.Strings(errs.Problems)
+		return nil, &errs
 	}
 
 	return &s, nil
 }
 
-// Save saves the spec to the given writer.
+// Save saves the spec to the given writer in YAML format.
 func (a *Spec) Save(w io.Writer) error {
-	return yaml.NewEncoder(w).Encode(a)
+	return a.SaveWithOptions(w, SaveOptions{})
+}
+
+// Supported formats for SaveOptions.
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// SaveOptions controls how a spec is serialized.
+type SaveOptions struct {
+	// Format is either FormatYAML (default) or FormatJSON.
+	Format string
+	// Comments maps top level field names to comments which are placed above
+	// the fields. Only used for YAML. See ParseComments.
+	Comments map[string]string
+}
+
+// SaveWithOptions saves the spec to the given writer in the given format.
+func (a *Spec) SaveWithOptions(w io.Writer, o SaveOptions) error {
+	var doc yaml.Node
+	if err := doc.Encode(a); err != nil {
+		return err
+	}
+
+	switch o.Format {
+	case "", FormatYAML:
+		for i := 0; i < len(doc.Content); i += 2 {
+			if c, ok := o.Comments[doc.Content[i].Value]; ok {
+				if i > 0 {
+					c = "\n" + c
+				}
+				doc.Content[i].HeadComment = c
+			}
+		}
+		enc := yaml.NewEncoder(w)
+		if err := enc.Encode(&doc); err != nil {
+			return err
+		}
+		return enc.Close()
+
+	case FormatJSON:
+		var b bytes.Buffer
+		if err := writeJSONNode(&b, &doc); err != nil {
+			return err
+		}
+		var ib bytes.Buffer
+		if err := json.Indent(&ib, b.Bytes(), "", "  "); err != nil {
+			return err
+		}
+		ib.WriteByte('\n')
+		_, err := ib.WriteTo(w)
+		return err
+
+	default:
+		return fmt.Errorf("unsupported format '%s'", o.Format)
+	}
+}
+
+// writeJSONNode writes the YAML node as compact JSON, preserving the order of
+// mapping keys.
+func writeJSONNode(b *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		return writeJSONNode(b, n.Content[0])
+	case yaml.MappingNode:
+		b.WriteByte('{')
+		for i := 0; i < len(n.Content); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			k, _ := json.Marshal(n.Content[i].Value)
+			b.Write(k)
+			b.WriteByte(':')
+			if err := writeJSONNode(b, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	case yaml.SequenceNode:
+		b.WriteByte('[')
+		for i, c := range n.Content {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := writeJSONNode(b, c); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	default:
+		var v interface{}
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		j, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(j)
+	}
+	return nil
+}
+
+var (
+	commentKeyPat      = regexp.MustCompile(`^(?:# )?([a-z_]+):`)
+	commentIndentedPat = regexp.MustCompile(`^#\s\s`)
+)
+
+// ParseComments extracts the comments describing each top level field from a
+// documented spec such as the example spec. A field's comment is the block of
+// comment lines immediately preceding the field or its commented out example,
+// including the leading '#' of each line.
+func ParseComments(r io.Reader) (map[string]string, error) {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Spec{})
+	for i := 0; i < t.NumField(); i++ {
+		fields[strings.SplitN(t.Field(i).Tag.Get("yaml"), ",", 2)[0]] = true
+	}
+
+	comments := map[string]string{}
+	var desc []string
+	afterKey := false
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		l := strings.TrimRight(sc.Text(), " \t")
+		if l == "" {
+			desc, afterKey = nil, false
+			continue
+		}
+		if m := commentKeyPat.FindStringSubmatch(l); m != nil && fields[m[1]] {
+			for len(desc) > 0 && desc[len(desc)-1] == "#" {
+				desc = desc[:len(desc)-1]
+			}
+			if _, ok := comments[m[1]]; !ok && len(desc) > 0 {
+				comments[m[1]] = strings.Join(desc, "\n")
+			}
+			desc, afterKey = nil, true
+			continue
+		}
+		if !strings.HasPrefix(l, "#") {
+			continue
+		}
+		// Indented comments after a field are the rest of its example.
+		if afterKey && (l == "#" || commentIndentedPat.MatchString(l)) {
+			continue
+		}
+		afterKey = false
+		desc = append(desc, l)
+	}
+	return comments, sc.Err()
 }
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
+	"sort"
 	"strconv"
 	"strings"
 
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/scheduler"
 	"github.com/spf13/cobra"
 )
 
@@ -21,7 +24,7 @@ func init() {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(c *cobra.Command, args []string) error {
 			fnName := args[0]
-			inf, err := info(fnName, ver)
+			inf, err := info(c.Context(), fnName, ver)
 			if err != nil {
 				return err
 			}
@@ -31,29 +34,45 @@ func init() {
 	addVersionFlag(infoCmd.Flags(), &ver)
 }
 
-// info returns information about a function.
-func info(fnName string, fnVer string) (map[string]string, error) {
-	inf := map[string]string{
+// fnSchedule is a schedule of a function as reported by info.
+type fnSchedule struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	State      string `json:"state"`
+	Target     string `json:"target"`
+}
+
+// fnEventSource is an event source mapping of a function as reported by info.
+type fnEventSource struct {
+	UUID        string `json:"uuid"`
+	EventSource string `json:"event_source"`
+	State       string `json:"state"`
+	Target      string `json:"target"`
+}
+
+// info returns information about a function, including the schedules and event
+// source mappings which can currently trigger it.
+func info(ctx context.Context, fnName string, fnVer string) (map[string]interface{}, error) {
+	inf := map[string]interface{}{
 		"name": fnName,
 		"url":  "",
 	}
-	ctx := context.Background()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return inf, fmt.Errorf("failed to load aws config: %s", err)
 	}
-	lambdaCl := lambda.NewFromConfig(acfg)
+	lambdaCl := clients.lambda()
 
 	// We kind of re-implement the login of versionFlag here, but it's necessary
 	// because there are minor differences and we also need to get more details
 	// out of the function alias.
 
 	if fnVer == latestPseudoVersion {
-		vers, err := versions(fnName)
+		v, err := resolveVersion(ctx, fnName, latestPseudoVersion)
 		if err != nil {
 			return inf, fmt.Errorf("failed to get versions: %s", err)
 		}
-		fnVer = strconv.Itoa(vers[len(vers)-1].Version)
+		fnVer = strconv.Itoa(v)
 
 	} else if _, err := strconv.Atoi(fnVer); err != nil { // not a number
 		fu, err := lambdaCl.GetFunctionUrlConfig(ctx, &lambda.GetFunctionUrlConfigInput{
@@ -86,5 +105,96 @@ func info(fnName string, fnVer string) (map[string]string, error) {
 	inf["resolved_image"] = *gfo.Code.ResolvedImageUri
 	inf["role"] = *gfo.Configuration.Role
 	inf["timestamp"] = *gfo.Configuration.LastModified
+
+	// Schedules are informational so callers without access to them can still
+	// get the rest of the info.
+
+	scheds, err := functionSchedules(ctx, clients.scheduler(), fnName)
+	if err != nil {
+		if apiErrorCode(err) != "AccessDeniedException" {
+			return inf, err
+		}
+		log.Printf("warning: skipping schedules: %s", err)
+	}
+	inf["schedules"] = scheds
+
+	// Event source mappings are created on the version rather than the alias.
+
+	esms, err := functionEventSources(ctx, lambdaCl, fmt.Sprintf("%s:%s", fnName, *gfo.Configuration.Version))
+	if err != nil {
+		return inf, err
+	}
+	inf["event_sources"] = esms
+
 	return inf, nil
 }
+
+// functionSchedules returns the schedules in the schedule group of the given
+// function sorted by name.
+func functionSchedules(ctx context.Context, schedCl *scheduler.Client, fnName string) ([]fnSchedule, error) {
+	groupName := scheduleGroupName(fnName)
+	var names []string
+	sp := scheduler.NewListSchedulesPaginator(schedCl, &scheduler.ListSchedulesInput{
+		GroupName: &groupName,
+	})
+	for sp.HasMorePages() {
+		page, err := sp.NextPage(ctx)
+		if err != nil {
+			if apiErrorCode(err) == "ResourceNotFoundException" {
+				break
+			}
+			return nil, fmt.Errorf("failed to list schedules: %w", err)
+		}
+		for _, sc := range page.Schedules {
+			names = append(names, *sc.Name)
+		}
+	}
+	sort.Strings(names)
+
+	scheds := make([]fnSchedule, len(names))
+	if err := parallel(ctx, len(names), func(ctx context.Context, i int) error {
+		gso, err := schedCl.GetSchedule(ctx, &scheduler.GetScheduleInput{
+			GroupName: &groupName,
+			Name:      &names[i],
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get schedule '%s': %w", names[i], err)
+		}
+		scheds[i] = fnSchedule{
+			Name:       names[i],
+			Expression: aws.ToString(gso.ScheduleExpression),
+			State:      string(gso.State),
+		}
+		if gso.Target != nil {
+			scheds[i].Target = aws.ToString(gso.Target.Arn)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return scheds, nil
+}
+
+// functionEventSources returns the event source mappings of the given
+// (qualified) function.
+func functionEventSources(ctx context.Context, lambdaCl *lambda.Client, fnName string) ([]fnEventSource, error) {
+	esms := []fnEventSource{}
+	pag := lambda.NewListEventSourceMappingsPaginator(lambdaCl, &lambda.ListEventSourceMappingsInput{
+		FunctionName: &fnName,
+	})
+	for pag.HasMorePages() {
+		page, err := pag.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list event source mappings: %s", err)
+		}
+		for _, m := range page.EventSourceMappings {
+			esms = append(esms, fnEventSource{
+				UUID:        aws.ToString(m.UUID),
+				EventSource: aws.ToString(m.EventSourceArn),
+				State:       aws.ToString(m.State),
+				Target:      aws.ToString(m.FunctionArn),
+			})
+		}
+	}
+	return esms, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	dockerclient "github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+
+	"github.com/mathspace/lambdafy/fnspec"
+)
+
+var initCmd *cobra.Command
+
+func init() {
+	var image, name, output string
+	var force bool
+	initCmd = &cobra.Command{
+		Use:   "init",
+		Short: "Generate a spec for an existing docker image",
+		Long: `Generate a spec for an existing docker image. The image is inspected for its
+exposed ports, entrypoint, command and env, and a spec with sensible defaults
+and commented out optional sections is written. See 'lambdafy example-spec' for
+all available settings.`,
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			if image == "" {
+				return errors.New("--image must be specified")
+			}
+			if output != "-" && !force {
+				if _, err := os.Stat(output); err == nil {
+					return fmt.Errorf("'%s' already exists - pass --force to overwrite it", output)
+				}
+			}
+			spec, err := generateInitSpec(c.Context(), image, name)
+			if err != nil {
+				return err
+			}
+			if output == "-" {
+				fmt.Print(spec)
+				return nil
+			}
+			if err := os.WriteFile(output, []byte(spec), 0644); err != nil {
+				return fmt.Errorf("failed to write spec: %s", err)
+			}
+			log.Printf("wrote spec to '%s' - review it and run 'lambdafy publish %s'", output, output)
+			return nil
+		},
+	}
+	initCmd.Flags().StringVar(&image, "image", "", "docker image to generate the spec for")
+	initCmd.Flags().StringVar(&name, "name", "", "name of the function (default: derived from the image name)")
+	initCmd.Flags().StringVar(&output, "output-file", "spec.yaml", "file to write the spec to, or - for stdout")
+	initCmd.Flags().BoolVar(&force, "force", false, "overwrite the output file if it exists")
+}
+
+// initSpecTemplate is the template of specs generated by init.
+var initSpecTemplate = template.Must(template.New("spec").Funcs(template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}).Parse(`# Generated by 'lambdafy init' from image '{{.Image}}'.
+# Commented out items are optional. Run 'lambdafy example-spec' for the
+# documentation of all settings.
+
+name: {{json .Name}}
+
+# Non-ECR images are lambdafied and pushed to an ECR repo named after the
+# function on publish.
+image: {{json .Image}}
+create_repo: true
+
+# Let lambdafy generate a role only allowing what the function needs.
+role: generate
+
+# Memory in MB (CPU scales with it) and timeout in seconds.
+memory: 512
+timeout: 30
+{{- if .Ports}}
+
+# The image exposes port(s) {{.Ports}}. Requests are sent to the port in the PORT
+# env var instead, so make sure your program listens on $PORT.
+{{- end}}
+{{- if or .Entrypoint .Command}}
+
+# The entrypoint and command of the image are used as is. Uncomment to override.
+#
+{{- if .Entrypoint}}
+# entrypoint: {{json .Entrypoint}}
+{{- end}}
+{{- if .Command}}
+# command: {{json .Command}}
+{{- end}}
+{{- end}}
+
+# env is added to the env of the image.
+{{- if .Env}}
+# The image already sets the following - uncomment to override.
+{{- end}}
+#
+# env:
+{{- range .Env}}
+#   {{.}}
+{{- else}}
+#   FOO: "bar"
+{{- end}}
+
+# cors allows browsers to call the function URL from other origins.
+#
+# cors:
+#   origins: ["https://example.com"]
+
+# sqs_triggers send SQS messages as POST requests to /_lambdafy/sqs.
+#
+# sqs_triggers:
+#   - arn: arn:aws:sqs:us-east-1:123456789012:my-queue
+
+# cron sends an empty POST request to /_lambdafy/cron?name=<name> on schedule.
+#
+# cron:
+#   hourly: "0 * * * ? *"
+
+# vpc_security_group_ids and vpc_subnet_ids run the function in a VPC.
+#
+# vpc_security_group_ids: [sg-0123456789abcdef0]
+# vpc_subnet_ids: [subnet-0123456789abcdef0]
+`))
+
+// initFnNameInvalidChars matches the characters not allowed in function (and
+// hence default ECR repo) names.
+var initFnNameInvalidChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// generateInitSpec inspects the given image and returns a spec for it.
+func generateInitSpec(ctx context.Context, image string, name string) (string, error) {
+	dc, err := dockerclient.NewClientWithOpts(
+		dockerclient.WithAPIVersionNegotiation(),
+		dockerclient.FromEnv,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to get docker client: %s", err)
+	}
+	img, _, err := dc.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect docker image '%s': %s", image, err)
+	}
+	if img.Architecture != "amd64" || img.Os != "linux" {
+		log.Printf("warning: platform of docker image '%s' must be linux/amd64 - rebuild it with --platform=linux/amd64", image)
+	}
+
+	if name == "" {
+		name = image
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+		name, _, _ = strings.Cut(name, "@")
+		name, _, _ = strings.Cut(name, ":")
+		name = strings.Trim(initFnNameInvalidChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+		if len(name) > 64 {
+			name = name[:64]
+		}
+	}
+
+	d := struct {
+		Name       string
+		Image      string
+		Ports      string
+		Entrypoint []string
+		Command    []string
+		Env        []string
+	}{
+		Name:  name,
+		Image: image,
+	}
+	if img.Config != nil {
+		var ports []string
+		for p := range img.Config.ExposedPorts {
+			ports = append(ports, string(p))
+		}
+		sort.Strings(ports)
+		d.Ports = strings.Join(ports, ", ")
+
+		// The proxy is prepended to the entrypoint of lambdafied images.
+		d.Entrypoint = img.Config.Entrypoint
+		if len(d.Entrypoint) > 0 && d.Entrypoint[0] == "/lambdafy-proxy" {
+			d.Entrypoint = d.Entrypoint[1:]
+		}
+		d.Command = img.Config.Cmd
+
+		for _, e := range img.Config.Env {
+			k, v, _ := strings.Cut(e, "=")
+			if k == "PATH" || k == "HOME" || k == "PORT" {
+				continue
+			}
+			vb, _ := json.Marshal(v)
+			d.Env = append(d.Env, fmt.Sprintf("%s: %s", k, vb))
+		}
+	}
+
+	b := bytes.Buffer{}
+	if err := initSpecTemplate.Execute(&b, d); err != nil {
+		return "", fmt.Errorf("failed to generate spec: %s", err)
+	}
+
+	// Make sure what we generate is actually valid.
+
+	if _, err := fnspec.Load(bytes.NewReader(b.Bytes()), nil); err != nil {
+		return "", fmt.Errorf("failed to generate a valid spec (try passing --name): %s", err)
+	}
+	return b.String(), nil
+}
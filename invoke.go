@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+
+	"github.com/mathspace/lambdafy/fnspec"
+)
+
+// invokeStatementPrefix is the prefix of the statement IDs of the invoke
+// permissions managed by lambdafy. Statements without it are left alone.
+const invokeStatementPrefix = "lambdafy-invoke-"
+
+// accountRootPat matches the IAM principal lambda stores account ID principals
+// as and captures the account ID.
+var accountRootPat = regexp.MustCompile(`^arn:aws[a-z-]*:iam::(\d{12}):root$`)
+
+// invokeStatementID returns the statement ID of the given invoke permission.
+// It's derived from the content of the permission so that any change results
+// in a new statement.
+func invokeStatementID(p *fnspec.InvokePermission) string {
+	h := md5.Sum([]byte(strings.Join([]string{
+		p.Principal, p.SourceARN, p.SourceAccount, invokeAction(p), p.Qualifier,
+	}, "\n")))
+	return invokeStatementPrefix + hex.EncodeToString(h[:8])
+}
+
+// invokeAction returns the action of the given invoke permission.
+func invokeAction(p *fnspec.InvokePermission) string {
+	if p.Action == "" {
+		return fnspec.DefaultInvokeAction
+	}
+	return p.Action
+}
+
+// lambdaPolicy is the subset of a lambda resource policy we care about.
+type lambdaPolicy struct {
+	Statement []struct {
+		Sid       string
+		Principal json.RawMessage
+		Action    string
+		Condition map[string]map[string]string
+	}
+}
+
+// getInvokePermissions returns the lambdafy managed invoke permissions on the
+// given qualifier of the function keyed by statement ID. An empty qualifier
+// refers to the unqualified function.
+func getInvokePermissions(ctx context.Context, lambdaCl *lambda.Client, fnName string, qualifier string) (map[string]*fnspec.InvokePermission, error) {
+	in := &lambda.GetPolicyInput{FunctionName: &fnName}
+	if qualifier != "" {
+		in.Qualifier = &qualifier
+	}
+	out, err := lambdaCl.GetPolicy(ctx, in)
+	if err != nil {
+		if apiErrorCode(err) == "ResourceNotFoundException" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var pol lambdaPolicy
+	if err := json.Unmarshal([]byte(aws.ToString(out.Policy)), &pol); err != nil {
+		return nil, fmt.Errorf("failed to decode policy: %s", err)
+	}
+
+	perms := map[string]*fnspec.InvokePermission{}
+	for _, st := range pol.Statement {
+		if !strings.HasPrefix(st.Sid, invokeStatementPrefix) {
+			continue
+		}
+		p := &fnspec.InvokePermission{
+			Action:    st.Action,
+			Qualifier: qualifier,
+		}
+		if p.Action == fnspec.DefaultInvokeAction {
+			p.Action = ""
+		}
+		var principal string
+		if err := json.Unmarshal(st.Principal, &principal); err != nil {
+			var principals map[string]string
+			if err := json.Unmarshal(st.Principal, &principals); err != nil {
+				return nil, fmt.Errorf("failed to decode principal of statement '%s': %s", st.Sid, err)
+			}
+			for _, v := range principals {
+				principal = v
+			}
+		}
+		if m := accountRootPat.FindStringSubmatch(principal); m != nil {
+			principal = m[1]
+		}
+		p.Principal = principal
+		for _, c := range st.Condition {
+			for k, v := range c {
+				switch strings.ToLower(k) {
+				case "aws:sourcearn":
+					p.SourceARN = v
+				case "aws:sourceaccount":
+					p.SourceAccount = v
+				}
+			}
+		}
+		perms[st.Sid] = p
+	}
+	return perms, nil
+}
+
+// functionInvokePermissions returns the lambdafy managed invoke permissions on
+// the function and all its aliases.
+func functionInvokePermissions(ctx context.Context, lambdaCl *lambda.Client, fnName string) (map[string]map[string]*fnspec.InvokePermission, error) {
+	qualifiers := []string{""}
+	pag := lambda.NewListAliasesPaginator(lambdaCl, &lambda.ListAliasesInput{
+		FunctionName: &fnName,
+	})
+	for pag.HasMorePages() {
+		p, err := pag.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list aliases: %s", err)
+		}
+		for _, a := range p.Aliases {
+			qualifiers = append(qualifiers, *a.Name)
+		}
+	}
+
+	perms := map[string]map[string]*fnspec.InvokePermission{}
+	for _, q := range qualifiers {
+		ps, err := getInvokePermissions(ctx, lambdaCl, fnName, q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get invoke permissions: %s", err)
+		}
+		perms[q] = ps
+	}
+	return perms, nil
+}
+
+// reconcileInvokePermissions adds the invoke permissions in the spec to the
+// function (or the alias given as their qualifier) and removes the
+// lambdafy managed ones no longer in the spec. Permissions on qualifiers which
+// do not exist yet are skipped with a warning.
+func reconcileInvokePermissions(ctx context.Context, lambdaCl *lambda.Client, spec *fnspec.Spec) error {
+	existing, err := functionInvokePermissions(ctx, lambdaCl, spec.Name)
+	if err != nil {
+		return err
+	}
+
+	desired := map[string]map[string]*fnspec.InvokePermission{}
+	for _, p := range spec.InvokePermissions {
+		if desired[p.Qualifier] == nil {
+			desired[p.Qualifier] = map[string]*fnspec.InvokePermission{}
+		}
+		desired[p.Qualifier][invokeStatementID(p)] = p
+	}
+
+	// Remove stale permissions
+
+	for q, ps := range existing {
+		for sid := range ps {
+			if _, ok := desired[q][sid]; ok {
+				continue
+			}
+			in := &lambda.RemovePermissionInput{
+				FunctionName: &spec.Name,
+				StatementId:  aws.String(sid),
+			}
+			if q != "" {
+				in.Qualifier = aws.String(q)
+			}
+			if err := retryOnResourceConflict(ctx, func() error {
+				_, err := lambdaCl.RemovePermission(ctx, in)
+				return err
+			}); err != nil && apiErrorCode(err) != "ResourceNotFoundException" {
+				return fmt.Errorf("failed to remove invoke permission '%s': %s", sid, err)
+			}
+		}
+	}
+
+	// Add missing permissions
+
+	var qualifiers []string
+	for q := range desired {
+		qualifiers = append(qualifiers, q)
+	}
+	sort.Strings(qualifiers)
+	for _, q := range qualifiers {
+		if _, ok := existing[q]; !ok && q != "" {
+			if _, err := lambdaCl.GetFunctionConfiguration(ctx, &lambda.GetFunctionConfigurationInput{
+				FunctionName: &spec.Name,
+				Qualifier:    aws.String(q),
+			}); err != nil {
+				if apiErrorCode(err) != "ResourceNotFoundException" {
+					return fmt.Errorf("failed to lookup '%s': %s", q, err)
+				}
+				log.Printf("warning: skipping invoke permissions on '%s' as it does not exist yet - publish again once it does", q)
+				continue
+			}
+		}
+		for sid, p := range desired[q] {
+			if _, ok := existing[q][sid]; ok {
+				continue
+			}
+			in := &lambda.AddPermissionInput{
+				FunctionName: &spec.Name,
+				StatementId:  aws.String(sid),
+				Action:       aws.String(invokeAction(p)),
+				Principal:    aws.String(p.Principal),
+			}
+			if q != "" {
+				in.Qualifier = aws.String(q)
+			}
+			if p.SourceARN != "" {
+				in.SourceArn = aws.String(p.SourceARN)
+			}
+			if p.SourceAccount != "" {
+				in.SourceAccount = aws.String(p.SourceAccount)
+			}
+			if err := retryOnResourceConflict(ctx, func() error {
+				_, err := lambdaCl.AddPermission(ctx, in)
+				return err
+			}); err != nil && !strings.Contains(err.Error(), "already exists") {
+				return fmt.Errorf("failed to add invoke permission for '%s': %s", p.Principal, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -3,9 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
-	"sort"
 
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	"github.com/spf13/cobra"
 )
@@ -15,37 +13,33 @@ var listCmd = &cobra.Command{
 	Aliases: []string{"ls"},
 	Short:   "List functions",
 	RunE: func(c *cobra.Command, args []string) error {
-		fns, err := listFunctions()
-		if err != nil {
-			return err
-		}
-		for _, f := range fns {
+		return eachFunction(c.Context(), func(f string) error {
 			fmt.Println(f)
-		}
-		return nil
+			return nil
+		})
 	},
 }
 
-// listFunctions lists all lambdafy functions.
-func listFunctions() ([]string, error) {
-	fns := []string{}
-	ctx := context.Background()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+// eachFunction calls fn with the name of each function as the pages of the
+// listing arrive so that results of large accounts can be streamed.
+func eachFunction(ctx context.Context, fn func(string) error) error {
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load aws config: %s", err)
+		return fmt.Errorf("failed to load aws config: %s", err)
 	}
-	lambdaCl := lambda.NewFromConfig(acfg)
+	lambdaCl := clients.lambda()
 
 	listPages := lambda.NewListFunctionsPaginator(lambdaCl, &lambda.ListFunctionsInput{})
 	for listPages.HasMorePages() {
 		p, err := listPages.NextPage(ctx)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		for _, f := range p.Functions {
-			fns = append(fns, *f.FunctionName)
+			if err := fn(*f.FunctionName); err != nil {
+				return err
+			}
 		}
 	}
-	sort.Strings(fns)
-	return fns, nil
+	return nil
 }
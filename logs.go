@@ -4,12 +4,13 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	logstypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
 	"github.com/spf13/cobra"
 )
 
@@ -27,27 +28,32 @@ func init() {
 		RunE: func(c *cobra.Command, args []string) error {
 			since := time.Now().Add(-sinceDur)
 			fnName := args[0]
-			ver, err := resolveVersion(fnName, ver)
+			ver, err := resolveVersion(c.Context(), fnName, ver)
 			if err != nil {
 				return fmt.Errorf("failed to resolve version: %s", err)
 			}
 
 			log.Printf("printing logs for version %d", ver)
 
-			var afterToken string
+			t, err := newLogTailer(c.Context(), fnName, ver)
+			if err != nil {
+				return err
+			}
 			for {
-				lgs, err := logs(fnName, ver, since, afterToken)
+				fetchedAt := time.Now()
+				lines, err := t.fetch(c.Context(), since)
 				if err != nil {
 					return err
 				}
-				for _, l := range lgs.lines {
+				for _, l := range lines {
 					fmt.Println(l)
 				}
 				if !tail {
 					return nil
 				}
-				afterToken = lgs.afterToken
-				since = time.Now().Add(-30 * time.Second)
+				// Streams already seen are read from where we left off. This only
+				// applies to new streams.
+				since = fetchedAt.Add(-30 * time.Second)
 				time.Sleep(2 * time.Second)
 			}
 		},
@@ -57,63 +63,165 @@ func init() {
 	logsCmd.Flags().DurationVarP(&sinceDur, "since", "s", time.Minute, "only print logs since this length of time ago")
 }
 
-type fnLogs struct {
-	// Token to pass to logs() to get more recent logs.
-	afterToken string
-	// Log lines in chronological order.
-	lines []string
+// logStreamLag is how far behind the last event time of a log stream reported
+// by DescribeLogStreams can be. It's only updated eventually.
+const logStreamLag = time.Hour
+
+// logTailer retrieves the logs of a function version. It remembers the streams
+// it has seen and how far it has read them so that repeated fetches only
+// return new log lines.
+type logTailer struct {
+	logsCl       *cloudwatchlogs.Client
+	logGroupName string
+	// Suffix of the date prefix of the names of the version's log streams.
+	streamMarker string
+	// Streams with events in the window of the last fetch keyed by name.
+	streams map[string]*logStream
+	// Whether all log streams have been listed once.
+	discovered bool
+}
+
+// logStream is the read position of a log stream.
+type logStream struct {
+	// Next forward token, nil if the stream has not been read yet.
+	token *string
+	// Last event or ingestion time of the stream when it was last read.
+	last int64
+}
+
+// newLogTailer returns a log tailer for the given function version.
+func newLogTailer(ctx context.Context, fnName string, version int) (*logTailer, error) {
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws config: %s", err)
+	}
+	return &logTailer{
+		logsCl:       clients.logs(),
+		logGroupName: fmt.Sprintf("/aws/lambda/%s", fnName),
+		streamMarker: fmt.Sprintf("/[%d]", version),
+		streams:      map[string]*logStream{},
+	}, nil
 }
 
-// logs returns the logs for a function at the specified version.
-// afterToken is a token to pass to get more recent logs.
-// This log retriever is super primitive, thanks to the complexities of AWS.
-func logs(fnName string, version int, since time.Time, afterToken string) (fnLogs, error) {
-	lgs := fnLogs{}
-	ctx := context.Background()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+// fetch returns the log lines, in chronological order, written since the last
+// fetch. Lines of streams not seen before are only returned if written after
+// since.
+func (t *logTailer) fetch(ctx context.Context, since time.Time) ([]string, error) {
+	updated, err := t.discover(ctx, since)
 	if err != nil {
-		return lgs, fmt.Errorf("failed to load aws config: %s", err)
+		return nil, err
 	}
-	logsCl := cloudwatchlogs.NewFromConfig(acfg)
-
-	logGroupName := aws.String(fmt.Sprintf("/aws/lambda/%s", fnName))
-
-	// This is a hack to get the logs for a specific version. To cater for
-	// logstreams that start just before a new date or run for multiple days, we
-	// look at logstreams a few days into the past first.
-	const maxDays = 2
-	prefixDate := since.UTC().AddDate(0, 0, -(maxDays - 1))
-	now := time.Now()
-
-	for prefixDate.Before(now) {
-		streamPrefix := fmt.Sprintf("%s/[%d]", prefixDate.Format("2006/01/02"), version)
-		pgr := cloudwatchlogs.NewFilterLogEventsPaginator(logsCl, &cloudwatchlogs.FilterLogEventsInput{
-			LogGroupName:        logGroupName,
-			StartTime:           aws.Int64(since.UnixMilli()),
-			LogStreamNamePrefix: aws.String(streamPrefix),
-			Limit:               aws.Int32(10000),
-		})
-		for pgr.HasMorePages() {
-			ents, err := pgr.NextPage(ctx)
+
+	type event struct {
+		ts  int64
+		msg string
+	}
+	var events []event
+	for _, name := range updated {
+		st := t.streams[name]
+		in := &cloudwatchlogs.GetLogEventsInput{
+			LogGroupName:  &t.logGroupName,
+			LogStreamName: aws.String(name),
+			StartFromHead: aws.Bool(true),
+			NextToken:     st.token,
+		}
+		if st.token == nil {
+			in.StartTime = aws.Int64(since.UnixMilli())
+		}
+		for {
+			out, err := t.logsCl.GetLogEvents(ctx, in)
 			if err != nil {
-				if !strings.Contains(err.Error(), "ResourceNotFoundException") {
-					return lgs, fmt.Errorf("failed to get log events: %s", err)
+				if apiErrorCode(err) == "ResourceNotFoundException" {
+					delete(t.streams, name)
+					break
 				}
+				return nil, fmt.Errorf("failed to get log events: %s", err)
+			}
+			for _, e := range out.Events {
+				events = append(events, event{aws.ToInt64(e.Timestamp), strings.TrimSuffix(aws.ToString(e.Message), "\n")})
+			}
+			// The same token is returned once the end of the stream is reached.
+			done := in.NextToken != nil && aws.ToString(out.NextForwardToken) == *in.NextToken
+			st.token = out.NextForwardToken
+			if done || len(out.Events) == 0 {
 				break
 			}
-			for _, e := range ents.Events {
-				if afterToken == "" {
-					lgs.lines = append(lgs.lines, strings.TrimSuffix(*e.Message, "\n"))
-				} else {
-					if *e.EventId == afterToken {
-						afterToken = ""
-					}
-				}
-				lgs.afterToken = *e.EventId
+			in.NextToken = out.NextForwardToken
+			in.StartTime = nil
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].ts < events[j].ts
+	})
+	lines := make([]string, len(events))
+	for i, e := range events {
+		lines[i] = e.msg
+	}
+	return lines, nil
+}
+
+// discover updates the known streams to the log streams of the version with
+// events since the given time, and returns the names of the ones written to
+// since they were last read. Streams are listed most recently written first so
+// listing stops as soon as older streams are reached. After the first call,
+// only the first page is listed as streams written to move to the top.
+func (t *logTailer) discover(ctx context.Context, since time.Time) ([]string, error) {
+	full := !t.discovered
+	cutoff := since.Add(-logStreamLag).UnixMilli()
+	inWindow := map[string]bool{}
+	var updated []string
+	pgr := cloudwatchlogs.NewDescribeLogStreamsPaginator(t.logsCl, &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName: &t.logGroupName,
+		OrderBy:      logstypes.OrderByLastEventTime,
+		Descending:   aws.Bool(true),
+	})
+pages:
+	for pgr.HasMorePages() {
+		p, err := pgr.NextPage(ctx)
+		if err != nil {
+			if apiErrorCode(err) == "ResourceNotFoundException" {
+				break
+			}
+			return nil, fmt.Errorf("failed to list log streams: %s", err)
+		}
+		for _, s := range p.LogStreams {
+			last := aws.ToInt64(s.LastEventTimestamp)
+			if ingested := aws.ToInt64(s.LastIngestionTime); ingested > last {
+				last = ingested
+			}
+			if last < cutoff {
+				break pages
+			}
+			name := aws.ToString(s.LogStreamName)
+			if !strings.Contains(name, t.streamMarker) {
+				continue
+			}
+			inWindow[name] = true
+			st, ok := t.streams[name]
+			if !ok {
+				st = &logStream{}
+				t.streams[name] = st
+			}
+			if last > st.last {
+				st.last = last
+				updated = append(updated, name)
 			}
 		}
-		prefixDate = prefixDate.AddDate(0, 0, 1)
+		if !full {
+			break
+		}
 	}
+	t.discovered = true
+
+	// Forget streams no longer written to so they aren't polled forever. Streams
+	// past the first page are only known to be out of the window once their
+	// last read event is.
 
-	return lgs, nil
+	for name, st := range t.streams {
+		if !inWindow[name] && (full || st.last < cutoff) {
+			delete(t.streams, name)
+		}
+	}
+	return updated, nil
 }
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"text/template"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -20,6 +23,7 @@ var (
 // Global flags.
 var (
 	outputTemplate string
+	verbose        bool
 )
 
 // formatOutput formats the output of a command.
@@ -55,6 +59,13 @@ func formatOutput(v interface{}) error {
 
 }
 
+// verbosef logs the given message only if verbose mode is enabled.
+func verbosef(format string, v ...interface{}) {
+	if verbose {
+		log.Printf(format, v...)
+	}
+}
+
 func main() {
 	app := &cobra.Command{
 		Use:     "lambdafy",
@@ -65,27 +76,36 @@ func main() {
 		},
 	}
 	app.PersistentFlags().StringVarP(&outputTemplate, "output", "o", "", "Output go style template")
+	app.PersistentFlags().BoolVar(&verbose, "verbose", false, "Log extra details such as retried AWS calls")
 
 	app.AddCommand(aliasCmd)
+	app.AddCommand(auditCmd)
 	app.AddCommand(cleanupRolesCmd)
 	app.AddCommand(createSampleProjectCmd)
+	app.AddCommand(concurrencyCmd)
+	app.AddCommand(cronCmd)
 	app.AddCommand(deleteCmd)
 	app.AddCommand(deployCmd)
+	app.AddCommand(encryptCmd)
 	app.AddCommand(exampleRoleCmd)
 	app.AddCommand(exampleSpecCmd)
 	app.AddCommand(infoCmd)
+	app.AddCommand(initCmd)
 	app.AddCommand(listCmd)
 	app.AddCommand(logsCmd)
 	app.AddCommand(makeCmd)
 	app.AddCommand(publishCmd)
 	app.AddCommand(pushCmd)
+	app.AddCommand(sbomCmd)
 	app.AddCommand(specCmd)
 	app.AddCommand(unaliasCmd)
 	app.AddCommand(undeployCmd)
+	app.AddCommand(urlCmd)
 	app.AddCommand(versionsCmd)
 
 	log.SetFlags(0)
-	if err := app.Execute(); err != nil {
+	rand.Seed(time.Now().UnixNano())
+	if err := app.ExecuteContext(withAWSClients(context.Background())); err != nil {
 		os.Exit(1)
 	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
 	"crypto/sha256"
 	_ "embed"
@@ -10,9 +11,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"strings"
 	"time"
 
-	dockertypes "github.com/docker/docker/api/types"
 	dockerclient "github.com/docker/docker/client"
 	"github.com/spf13/cobra"
 )
@@ -22,19 +24,51 @@ import (
 //go:embed proxy-linux-amd64
 var proxyBinary []byte
 
-var makeCmd = &cobra.Command{
-	Use:   "make image-name",
-	Short: "Modify a docker image by adding lambdafy proxy to it",
-	Args:  cobra.ExactArgs(1),
-	RunE: func(c *cobra.Command, args []string) error {
-		return lambdafyImage(args[0])
-	},
+var makeCmd *cobra.Command
+
+func init() {
+	var prov provenance
+	makeCmd = &cobra.Command{
+		Use:   "make image-name",
+		Short: "Modify a docker image by adding lambdafy proxy to it",
+		Long:  "Modify a docker image by adding lambdafy proxy to it. The source git commit and the builder identity, if given, are recorded as image labels. Labels already on the image are kept otherwise.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			return lambdafyImage(c.Context(), args[0], prov)
+		},
+	}
+	makeCmd.Flags().StringVar(&prov.Commit, "source-commit", "", "Source git commit to record in the image, e.g. $(git rev-parse HEAD) - not recorded by default as the image may not be built from the current directory")
+	makeCmd.Flags().StringVar(&prov.Builder, "builder", "", "Builder identity to record in the image, e.g. the CI job URL - not recorded by default as it would make the image differ per build host")
+}
+
+// Labels recording the provenance of lambdafied images.
+const (
+	sourceCommitLabel = "lambdafy.source.commit"
+	builderLabel      = "lambdafy.builder"
+)
+
+// provenance identifies where a lambdafied image comes from.
+type provenance struct {
+	Commit  string
+	Builder string
 }
 
-// lambdafyImage modifies the image by adding lambda proxy to it.
-func lambdafyImage(imgName string) error {
+// labels returns the image labels for the provenance. Empty fields have no
+// label so that the ones already on the image are kept.
+func (p provenance) labels() map[string]string {
+	l := map[string]string{}
+	if p.Commit != "" {
+		l[sourceCommitLabel] = p.Commit
+	}
+	if p.Builder != "" {
+		l[builderLabel] = p.Builder
+	}
+	return l
+}
 
-	ctx := context.Background()
+// lambdafyImage modifies the image by adding lambda proxy to it and records
+// the given provenance in its labels.
+func lambdafyImage(ctx context.Context, imgName string, prov provenance) error {
 
 	// Setup client
 
@@ -54,12 +88,20 @@ func lambdafyImage(imgName string) error {
 		return fmt.Errorf("failed to inspect docker image '%s': %s", imgName, err)
 	}
 
-	// Check if the image is already lambdafied with the same proxy version.
-	// If so, we can skip the rest of the process.
+	// Check if the image is already lambdafied with the same proxy version and
+	// provenance. If so, we can skip the rest of the process.
 
 	proxyChksum := sha256.Sum256(proxyBinary)
 	proxyChksumHex := hex.EncodeToString(proxyChksum[:])
-	if proxyChksumHex == img.Config.Labels["lambdafy.proxy.checksum"] {
+	labels := prov.labels()
+	if proxyChksumHex == img.Config.Labels[proxyChecksumLabel] && func() bool {
+		for k, v := range labels {
+			if img.Config.Labels[k] != v {
+				return false
+			}
+		}
+		return true
+	}() {
 		log.Print("image is already lambdafied with the same proxy version - skipping")
 		return nil
 	}
@@ -68,60 +110,304 @@ func lambdafyImage(imgName string) error {
 		return fmt.Errorf("platform of docker image '%s' must be linux/amd64", imgName)
 	}
 
-	// In case the image is already lambdafied, we need to remove the old proxy
-	// entry from command line.
+	// The lambdafied image is loaded back under the tag it's saved with, so it
+	// must be saved by tag. Saving by repo name alone would save all its tags.
 
-	if len(img.Config.Entrypoint) > 0 && img.Config.Entrypoint[0] == "/lambdafy-proxy" {
-		img.Config.Entrypoint = img.Config.Entrypoint[1:]
+	if id := strings.TrimPrefix(imgName, "sha256:"); len(id) >= 12 && strings.HasPrefix(strings.TrimPrefix(img.ID, "sha256:"), id) {
+		return fmt.Errorf("docker image '%s' must be referenced by name and tag rather than ID", imgName)
+	}
+	if i := strings.LastIndex(imgName, "/"); !strings.ContainsAny(imgName[i+1:], ":@") {
+		imgName += ":" + defaultImageTag
 	}
 
-	ep, err := json.Marshal(append([]string{"/lambdafy-proxy"}, img.Config.Entrypoint...))
-	if err != nil {
-		return fmt.Errorf("failed to marshal docker image '%s' entrypoint to json: %s", imgName, err)
+	// Append a layer with the proxy to the image and load it back in place of
+	// the original. This neither runs a build nor pulls the base image, and
+	// results in the same image every time for the same input.
+
+	log.Print("adding lambdafy proxy layer to the image")
+
+	labels[proxyChecksumLabel] = proxyChksumHex
+	if err := appendProxyLayer(ctx, dc, imgName, labels); err != nil {
+		return fmt.Errorf("failed to lambdafy image '%s': %s", imgName, err)
 	}
 
-	cmd, err := json.Marshal(img.Config.Cmd)
+	return nil
+}
+
+// proxyChecksumLabel is the image label holding the SHA256 checksum of the
+// proxy binary the image is lambdafied with.
+const proxyChecksumLabel = "lambdafy.proxy.checksum"
+
+// dockerArchiveManifest is an entry of manifest.json of the archives produced
+// by docker save.
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// appendProxyLayer saves the image from docker, appends a layer containing the
+// proxy binary to it, prefixes its entrypoint with the proxy, adds the given
+// labels to its config and loads the result back under the same tags.
+func appendProxyLayer(ctx context.Context, dc *dockerclient.Client, imgName string, labels map[string]string) error {
+
+	// Save the image to a temp file as the archive needs to be read twice - once
+	// to find the manifest and config and again to copy the layers.
+
+	rc, err := dc.ImageSave(ctx, []string{imgName})
 	if err != nil {
-		return fmt.Errorf("failed to marshal docker image '%s' command to json: %s", imgName, err)
+		return fmt.Errorf("failed to save image: %s", err)
+	}
+	defer rc.Close()
+	f, err := os.CreateTemp("", "lambdafy-image-*.tar")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, rc); err != nil {
+		return fmt.Errorf("failed to save image: %s", err)
 	}
 
-	// Build a new docker image with the proxy embedded
-
-	dockerFile := fmt.Sprintf(`
-FROM --platform=linux/amd64 %s
-RUN rm -f /lambdafy-proxy
-COPY --chmod=775 lambdafy-proxy /
-ENTRYPOINT %s
-CMD %s
-LABEL "lambdafy.proxy.checksum"="%s"
-`, imgName, string(ep), string(cmd), proxyChksumHex)
+	var manifests []dockerArchiveManifest
+	if err := readArchiveFile(f, "manifest.json", func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&manifests)
+	}); err != nil {
+		return fmt.Errorf("failed to read image manifest: %s", err)
+	}
+	if len(manifests) != 1 {
+		return fmt.Errorf("expected 1 image in the saved archive but got %d", len(manifests))
+	}
+	m := manifests[0]
+	if len(m.RepoTags) == 0 {
+		return fmt.Errorf("image '%s' has no tags to load the lambdafied image back under - reference it by name and tag", imgName)
+	}
+	var cfg []byte
+	if err := readArchiveFile(f, m.Config, func(r io.Reader) error {
+		cfg, err = io.ReadAll(r)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to read image config: %s", err)
+	}
 
-	r, w := io.Pipe()
+	// Build the proxy layer. Overwriting /lambdafy-proxy replaces the proxy of
+	// images which are already lambdafied.
 
 	t := time.UnixMicro(0)
+	layer := bytes.Buffer{}
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:       "lambdafy-proxy",
+		Mode:       0775,
+		Size:       int64(len(proxyBinary)),
+		ModTime:    t,
+		AccessTime: t,
+		ChangeTime: t,
+		Format:     tar.FormatPAX,
+	}); err != nil {
+		return fmt.Errorf("failed to build proxy layer: %s", err)
+	}
+	if _, err := tw.Write(proxyBinary); err != nil {
+		return fmt.Errorf("failed to build proxy layer: %s", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to build proxy layer: %s", err)
+	}
+	layerChksum := sha256.Sum256(layer.Bytes())
+	layerChksumHex := hex.EncodeToString(layerChksum[:])
+
+	cfg, err = patchImageConfig(cfg, "sha256:"+layerChksumHex, labels)
+	if err != nil {
+		return err
+	}
+	cfgChksum := sha256.Sum256(cfg)
+	cfgName := hex.EncodeToString(cfgChksum[:]) + ".json"
+	layerName := layerChksumHex + "/layer.tar"
+
+	newManifest, err := json.Marshal([]dockerArchiveManifest{{
+		Config:   cfgName,
+		RepoTags: m.RepoTags,
+		Layers:   append(m.Layers, layerName),
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to encode image manifest: %s", err)
+	}
+
+	// Write the new archive while it's being loaded. Only the existing layers
+	// are copied over - the manifest is replaced, and OCI index files are left
+	// out so that docker uses manifest.json.
+
+	pr, pw := io.Pipe()
 	go func() {
-		tr := tar.NewWriter(w)
-		_ = tr.WriteHeader(&tar.Header{Name: "Dockerfile", Size: int64(len(dockerFile)), ModTime: t, AccessTime: t, ChangeTime: t})
-		_, _ = tr.Write([]byte(dockerFile))
-		_ = tr.WriteHeader(&tar.Header{Name: "lambdafy-proxy", Size: int64(len(proxyBinary)), ModTime: t, AccessTime: t, ChangeTime: t})
-		_, _ = tr.Write(proxyBinary)
-		_ = tr.Close()
-		_ = w.Close()
+		pw.CloseWithError(func() error {
+			tw := tar.NewWriter(pw)
+			keep := map[string]bool{}
+			for _, l := range m.Layers {
+				keep[l] = true
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			tr := tar.NewReader(f)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if !keep[h.Name] {
+					continue
+				}
+				if err := tw.WriteHeader(h); err != nil {
+					return err
+				}
+				if _, err := io.Copy(tw, tr); err != nil {
+					return err
+				}
+			}
+			for _, e := range []struct {
+				name string
+				data []byte
+			}{
+				{layerName, layer.Bytes()},
+				{cfgName, cfg},
+				{"manifest.json", newManifest},
+			} {
+				if err := tw.WriteHeader(&tar.Header{
+					Name:    e.name,
+					Mode:    0644,
+					Size:    int64(len(e.data)),
+					ModTime: t,
+				}); err != nil {
+					return err
+				}
+				if _, err := tw.Write(e.data); err != nil {
+					return err
+				}
+			}
+			return tw.Close()
+		}())
 	}()
 
-	resp, err := dc.ImageBuild(ctx, r, dockertypes.ImageBuildOptions{
-		Tags:           []string{imgName},
-		Version:        dockertypes.BuilderBuildKit,
-		Platform:       "linux/amd64",
-		SuppressOutput: true,
-	})
+	res, err := dc.ImageLoad(ctx, pr, true)
 	if err != nil {
-		return fmt.Errorf("failed to build lambdafied image: %s", err)
+		pr.CloseWithError(err)
+		return fmt.Errorf("failed to load lambdafied image: %s", err)
 	}
-	defer resp.Body.Close()
-	if err := processDockerResponse(resp.Body); err != nil {
-		return fmt.Errorf("failed to build lambdafied image: %s", err)
+	defer res.Body.Close()
+	if err := processDockerResponse(res.Body); err != nil {
+		return fmt.Errorf("failed to load lambdafied image: %s", err)
 	}
-
 	return nil
 }
+
+// readArchiveFile calls fn with the content of the named file in the tar
+// archive.
+func readArchiveFile(f io.ReadSeeker, name string, fn func(io.Reader) error) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("'%s' not found in image archive", name)
+		}
+		if err != nil {
+			return err
+		}
+		if h.Name == name {
+			return fn(tr)
+		}
+	}
+}
+
+// patchImageConfig returns the given image config with the layer of the given
+// diff ID appended, the entrypoint prefixed with the proxy and the given labels
+// added. Fields not touched are preserved as is.
+func patchImageConfig(cfg []byte, diffID string, labels map[string]string) ([]byte, error) {
+	var c map[string]json.RawMessage
+	if err := json.Unmarshal(cfg, &c); err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %s", err)
+	}
+
+	// Container config
+
+	var cc map[string]json.RawMessage
+	if err := json.Unmarshal(c["config"], &cc); err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %s", err)
+	}
+	if cc == nil {
+		cc = map[string]json.RawMessage{}
+	}
+	var ep []string
+	var imgLabels map[string]string
+	if err := unmarshalIfSet(cc["Entrypoint"], &ep); err != nil {
+		return nil, fmt.Errorf("failed to decode image entrypoint: %s", err)
+	}
+	if err := unmarshalIfSet(cc["Labels"], &imgLabels); err != nil {
+		return nil, fmt.Errorf("failed to decode image labels: %s", err)
+	}
+
+	// In case the image is already lambdafied, we need to remove the old proxy
+	// entry from command line.
+
+	if len(ep) > 0 && ep[0] == "/lambdafy-proxy" {
+		ep = ep[1:]
+	}
+	ep = append([]string{"/lambdafy-proxy"}, ep...)
+	if imgLabels == nil {
+		imgLabels = map[string]string{}
+	}
+	for k, v := range labels {
+		imgLabels[k] = v
+	}
+	var err error
+	if cc["Entrypoint"], err = json.Marshal(ep); err != nil {
+		return nil, err
+	}
+	if cc["Labels"], err = json.Marshal(imgLabels); err != nil {
+		return nil, err
+	}
+	if c["config"], err = json.Marshal(cc); err != nil {
+		return nil, err
+	}
+
+	// Root filesystem and history
+
+	var rootfs struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	}
+	if err := json.Unmarshal(c["rootfs"], &rootfs); err != nil {
+		return nil, fmt.Errorf("failed to decode image rootfs: %s", err)
+	}
+	rootfs.DiffIDs = append(rootfs.DiffIDs, diffID)
+	if c["rootfs"], err = json.Marshal(rootfs); err != nil {
+		return nil, err
+	}
+	var history []map[string]interface{}
+	if err := unmarshalIfSet(c["history"], &history); err != nil {
+		return nil, fmt.Errorf("failed to decode image history: %s", err)
+	}
+	h := map[string]interface{}{"created_by": "lambdafy make"}
+	if created, ok := c["created"]; ok {
+		h["created"] = created
+	}
+	history = append(history, h)
+	if c["history"], err = json.Marshal(history); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(c)
+}
+
+// unmarshalIfSet decodes the JSON into v unless it's empty or null.
+func unmarshalIfSet(b json.RawMessage, v interface{}) error {
+	if len(b) == 0 || string(b) == "null" {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// redacted replaces the values of sensitive headers and query parameters in
+// access logs.
+const redacted = "[REDACTED]"
+
+// defaultRedactHeaders are the lower case names of the headers always redacted
+// in access logs.
+var defaultRedactHeaders = []string{
+	"authorization",
+	"cookie",
+	"proxy-authorization",
+	"set-cookie",
+	"x-amz-security-token",
+	"x-api-key",
+}
+
+// defaultRedactQuery are the patterns of the names of the query parameters
+// always redacted in access logs.
+var defaultRedactQuery = []string{
+	"*token*",
+	"*secret*",
+	"*password*",
+	"*signature*",
+	"*api_key*",
+	"*apikey*",
+	"code",
+}
+
+// accessLogEntry is a single line of the access log. Request and response
+// bodies are never logged.
+type accessLogEntry struct {
+	RequestID       string            `json:"request_id"`
+	Method          string            `json:"method"`
+	Path            string            `json:"path"`
+	Query           string            `json:"query,omitempty"`
+	SourceIP        string            `json:"source_ip"`
+	Status          int               `json:"status"`
+	DurationMs      int64             `json:"duration_ms"`
+	Error           string            `json:"error,omitempty"`
+	RequestHeaders  map[string]string `json:"request_headers"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+}
+
+// logAccess logs the given request and its response with sensitive headers and
+// query parameters redacted.
+func logAccess(req events.APIGatewayV2HTTPRequest, res events.APIGatewayV2HTTPResponse, err error, d time.Duration) {
+	e := accessLogEntry{
+		RequestID:       req.RequestContext.RequestID,
+		Method:          req.RequestContext.HTTP.Method,
+		Path:            req.RawPath,
+		Query:           redactQueryString(strings.TrimPrefix(req.RawQueryString, "?")),
+		SourceIP:        req.RequestContext.HTTP.SourceIP,
+		Status:          res.StatusCode,
+		DurationMs:      d.Milliseconds(),
+		RequestHeaders:  map[string]string{},
+		ResponseHeaders: map[string]string{},
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if len(req.Cookies) > 0 {
+		e.RequestHeaders["cookie"] = redacted
+	}
+	for k, v := range req.Headers {
+		e.RequestHeaders[strings.ToLower(k)] = redactHeader(k, v)
+	}
+	for k, v := range res.Headers {
+		e.ResponseHeaders[strings.ToLower(k)] = redactHeader(k, v)
+	}
+	for k, vs := range res.MultiValueHeaders {
+		e.ResponseHeaders[strings.ToLower(k)] = redactHeader(k, strings.Join(vs, ", "))
+	}
+	if len(res.Cookies) > 0 {
+		e.ResponseHeaders["set-cookie"] = redacted
+	}
+	b, _ := json.Marshal(e)
+	log.Printf("access: %s", b)
+}
+
+// redactHeader returns the value of the given header or redacted if it's
+// sensitive.
+func redactHeader(name string, value string) string {
+	name = strings.ToLower(name)
+	for _, h := range redactHeaders {
+		if name == h {
+			return redacted
+		}
+	}
+	return value
+}
+
+// redactQueryString returns the given raw query string with the values of the
+// sensitive parameters redacted. The order of the parameters is preserved.
+func redactQueryString(q string) string {
+	if q == "" {
+		return ""
+	}
+	params := strings.Split(q, "&")
+	for i, p := range params {
+		k, _, hasValue := strings.Cut(p, "=")
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+		name = strings.ToLower(name)
+		for _, pat := range redactQuery {
+			if ok, _ := path.Match(pat, name); ok {
+				if hasValue {
+					params[i] = k + "=" + redacted
+				}
+				break
+			}
+		}
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Proxy settings. They are read from lambdafy prefixed env vars (e.g.
+// LAMBDAFY_SQS_ENVELOPE) which are set in the env section of the spec.
+var (
+	// sqsEnvelope causes SQS messages to be sent to the user program as JSON
+	// objects including all message metadata rather than just the body.
+	sqsEnvelope bool
+
+	// sqsConcurrency limits the number of SQS records of a batch processed
+	// simultaneously. Zero means all records of a batch are processed at once.
+	sqsConcurrency int
+
+	// sqsRecordTimeout limits the time spent processing each SQS record. Zero
+	// means no limit other than the lambda timeout.
+	sqsRecordTimeout time.Duration
+
+	// deadlineMargin is how long before the lambda deadline outstanding SQS and
+	// cron requests are cancelled. It's capped at a quarter of the remaining
+	// time of each invocation.
+	deadlineMargin time.Duration
+
+	// accessLog enables logging a JSON line for each HTTP request with
+	// sensitive headers and query parameters redacted.
+	accessLog bool
+
+	// redactHeaders are the lower case names of the headers redacted in access
+	// logs in addition to defaultRedactHeaders.
+	redactHeaders []string
+
+	// redactQuery are the patterns (see path.Match) matched against the lower
+	// case names of the query parameters redacted in access logs in addition to
+	// defaultRedactQuery.
+	redactQuery []string
+
+	// upstreamKeepAlive enables reusing connections to the user program.
+	upstreamKeepAlive bool
+
+	// upstreamMaxIdleConns limits the idle connections kept open to the user
+	// program when keep-alive is enabled.
+	upstreamMaxIdleConns int
+
+	// upstreamResponseHeaderTimeout limits the time waiting for the response
+	// headers of the user program. Zero means no limit.
+	upstreamResponseHeaderTimeout time.Duration
+
+	// upstreamTLS makes the proxy talk HTTPS to the user program.
+	upstreamTLS bool
+
+	// upstreamTLSInsecure skips verifying the certificate of the user program,
+	// which is typically self-signed as it's only reached via localhost.
+	upstreamTLSInsecure bool
+)
+
+// loadConfig loads the proxy settings from env vars. It must be called before
+// lambdafy prefixed env vars are removed.
+func loadConfig() {
+	sqsEnvelope = configBool("SQS_ENVELOPE", false)
+	sqsConcurrency = configInt("SQS_CONCURRENCY", 0)
+	sqsRecordTimeout = configDuration("SQS_RECORD_TIMEOUT", 0)
+	deadlineMargin = configDuration("DEADLINE_MARGIN", 2*time.Second)
+	accessLog = configBool("ACCESS_LOG", false)
+	redactHeaders = append(defaultRedactHeaders, configList("REDACT_HEADERS")...)
+	redactQuery = append(defaultRedactQuery, configList("REDACT_QUERY")...)
+	upstreamKeepAlive = configBool("UPSTREAM_KEEPALIVE", false)
+	upstreamMaxIdleConns = configInt("UPSTREAM_MAX_IDLE_CONNS", 100)
+	upstreamResponseHeaderTimeout = configDuration("UPSTREAM_RESPONSE_HEADER_TIMEOUT", 0)
+	upstreamTLS = configBool("UPSTREAM_TLS", false)
+	upstreamTLSInsecure = configBool("UPSTREAM_TLS_INSECURE", false)
+	client = newUpstreamClient()
+}
+
+// configList returns the lower case comma separated values of the given
+// lambdafy prefixed env var.
+func configList(name string) []string {
+	var l []string
+	for _, v := range strings.Split(os.Getenv(lambdafyEnvPrefix+name), ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// configBool returns the boolean value of the given lambdafy prefixed env var
+// or def if it's not set or invalid.
+func configBool(name string, def bool) bool {
+	v, ok := os.LookupEnv(lambdafyEnvPrefix + name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("warning: invalid value '%s' for %s%s - using default %t", v, lambdafyEnvPrefix, name, def)
+		return def
+	}
+	return b
+}
+
+// configInt returns the non-negative integer value of the given lambdafy
+// prefixed env var or def if it's not set or invalid.
+func configInt(name string, def int) int {
+	v, ok := os.LookupEnv(lambdafyEnvPrefix + name)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		log.Printf("warning: invalid value '%s' for %s%s - using default %d", v, lambdafyEnvPrefix, name, def)
+		return def
+	}
+	return i
+}
+
+// configDuration returns the non-negative duration value (e.g. 30s) of the
+// given lambdafy prefixed env var or def if it's not set or invalid.
+func configDuration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(lambdafyEnvPrefix + name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("warning: invalid value '%s' for %s%s - using default %s", v, lambdafyEnvPrefix, name, def)
+		return def
+	}
+	return d
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func handleCron(ctx context.Context, cronName string) error {
-	u := fmt.Sprintf("http://%s/_lambdafy/cron?name=%s", appEndpoint, url.QueryEscape(cronName))
+	u := fmt.Sprintf("%s://%s/_lambdafy/cron?name=%s", upstreamScheme(), appEndpoint, url.QueryEscape(cronName))
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
 	if err != nil {
 		return fmt.Errorf("error creating HTTP request for cron '%s': %v", cronName, err)
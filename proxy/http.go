@@ -7,18 +7,48 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"log"
+	"mime"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 )
 
+// functionVersionHeader is the response header carrying the version of the
+// function that served the request. It is used by lambdafy deploy to verify
+// which version an alias is actually serving.
+const functionVersionHeader = "X-Lambdafy-Version"
+
+// instanceIDHeader is the response header carrying the random identifier of
+// the sandbox that served the request. It is used by lambdafy deploy to count
+// the sandboxes warmed up by priming.
+const instanceIDHeader = "X-Lambdafy-Instance"
+
+// maxResponseBodySize is the maximum size of the (possibly base64 encoded)
+// response body. Lambda limits the whole response payload to 6MB and some room
+// is left for the headers and the rest of the payload.
+const maxResponseBodySize = 6*1024*1024 - 64*1024
+
+// maxCompressionRatio bounds how much larger than maxResponseBodySize a
+// response body can be and still be read in the hope that it fits once
+// compressed.
+const maxCompressionRatio = 8
+
 // handleHTTP handles API Gateway HTTP events and translates them to HTTP
 // requests to the user program.
 func handleHTTP(ctx context.Context, req events.APIGatewayV2HTTPRequest) (res events.APIGatewayV2HTTPResponse, err error) {
 
+	if accessLog {
+		start := time.Now()
+		defer func() {
+			logAccess(req, res, err, time.Since(start))
+		}()
+	}
+
 	// Ignore special /_lambdafy paths
 
 	if strings.HasPrefix(req.RawPath, "/_lambdafy/") {
@@ -26,16 +56,14 @@ func handleHTTP(ctx context.Context, req events.APIGatewayV2HTTPRequest) (res ev
 		return
 	}
 
-	// Build standard HTTP request from the API Gateway request
+	// Build standard HTTP request from the API Gateway request, streaming the
+	// body to the user program without buffering it.
 
-	body := req.Body
+	var body io.Reader = strings.NewReader(req.Body)
+	bodyLen := int64(len(req.Body))
 	if req.IsBase64Encoded {
-		var b []byte
-		b, err = base64.StdEncoding.DecodeString(body)
-		if err != nil {
-			return
-		}
-		body = string(b)
+		body = base64.NewDecoder(base64.StdEncoding, body)
+		bodyLen = base64DecodedLen(req.Body)
 	}
 
 	if req.RawPath == "" {
@@ -44,13 +72,13 @@ func handleHTTP(ctx context.Context, req events.APIGatewayV2HTTPRequest) (res ev
 	if req.RawQueryString != "" {
 		req.RawQueryString = "?" + req.RawQueryString
 	}
-	u, _ := url.Parse(fmt.Sprintf("http://%s%s%s", appEndpoint, req.RawPath, req.RawQueryString))
+	u, _ := url.Parse(fmt.Sprintf("%s://%s%s%s", upstreamScheme(), appEndpoint, req.RawPath, req.RawQueryString))
 
-	r, err := http.NewRequestWithContext(ctx, req.RequestContext.HTTP.Method, u.String(), strings.NewReader(body))
+	r, err := http.NewRequestWithContext(ctx, req.RequestContext.HTTP.Method, u.String(), body)
 	if err != nil {
 		return
 	}
-	r.Header.Add("Content-Length", strconv.Itoa(len(body)))
+	r.ContentLength = bodyLen
 	gzipAllowed := false
 	for k, v := range req.Headers {
 		k = strings.ToLower(k)
@@ -62,6 +90,8 @@ func handleHTTP(ctx context.Context, req events.APIGatewayV2HTTPRequest) (res ev
 			if strings.Contains(v, "gzip") {
 				gzipAllowed = true
 			}
+		case "content-length":
+			// Set from the body above.
 		default:
 			r.Header.Add(k, v)
 		}
@@ -73,12 +103,21 @@ func handleHTTP(ctx context.Context, req events.APIGatewayV2HTTPRequest) (res ev
 	}
 	defer s.Body.Close()
 
-	// Build API Gateway response from standard HTTP response
+	// Build API Gateway response from standard HTTP response. Reading stops as
+	// soon as the body is known to exceed the lambda response size limit, even
+	// after compressing it.
 
-	resBody, err := io.ReadAll(s.Body)
+	readLimit := int64(maxResponseBodySize)
+	if gzipAllowed && s.Header.Get("Content-Encoding") == "" {
+		readLimit *= maxCompressionRatio
+	}
+	resBody, err := io.ReadAll(io.LimitReader(s.Body, readLimit+1))
 	if err != nil {
 		return
 	}
+	if int64(len(resBody)) > readLimit {
+		return responseTooLarge(), nil
+	}
 
 	res.Headers = map[string]string{}
 	res.MultiValueHeaders = map[string][]string{}
@@ -95,9 +134,19 @@ func handleHTTP(ctx context.Context, req events.APIGatewayV2HTTPRequest) (res ev
 		res.Headers["Content-Encoding"] = "gzip"
 	}
 
+	// Only binary bodies need to be base64 encoded which inflates them by a
+	// third.
+
 	res.StatusCode = s.StatusCode
-	res.IsBase64Encoded = true
-	res.Body = base64.StdEncoding.EncodeToString(resBody)
+	if res.Headers["Content-Encoding"] == "" && s.Header.Get("Content-Encoding") == "" && isTextContent(s.Header.Get("Content-Type"), resBody) {
+		res.Body = string(resBody)
+	} else {
+		res.IsBase64Encoded = true
+		res.Body = base64.StdEncoding.EncodeToString(resBody)
+	}
+	if len(res.Body) > maxResponseBodySize {
+		return responseTooLarge(), nil
+	}
 	for k, vs := range s.Header {
 		if strings.ToLower(k) == "set-cookie" {
 			res.Cookies = append(res.Cookies, vs...)
@@ -110,6 +159,54 @@ func handleHTTP(ctx context.Context, req events.APIGatewayV2HTTPRequest) (res ev
 		}
 	}
 	res.Headers["Via"] = "1.1 lambdafy (" + version + ")"
+	res.Headers[functionVersionHeader] = functionVersion
+	res.Headers[instanceIDHeader] = instanceID
 
 	return
 }
+
+// responseTooLarge returns the response sent in place of responses that are
+// too large for lambda to return.
+func responseTooLarge() events.APIGatewayV2HTTPResponse {
+	log.Printf("error: response body exceeds the %d bytes limit of lambda", maxResponseBodySize)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusBadGateway,
+		Headers: map[string]string{
+			"Content-Type": "text/plain; charset=utf-8",
+			"Via":          "1.1 lambdafy (" + version + ")",
+		},
+		Body: "lambdafy: response body is too large for lambda (max 6MB)\n",
+	}
+}
+
+// base64DecodedLen returns the exact length of the decoded form of the given
+// padded base64 string.
+func base64DecodedLen(s string) int64 {
+	n := int64(len(s)) / 4 * 3
+	if strings.HasSuffix(s, "==") {
+		n -= 2
+	} else if strings.HasSuffix(s, "=") {
+		n--
+	}
+	return n
+}
+
+// isTextContent returns true if the body with the given content type can be
+// returned as is without base64 encoding.
+func isTextContent(contentType string, body []byte) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "+json"),
+		strings.HasSuffix(mt, "+xml"),
+		mt == "application/json",
+		mt == "application/javascript",
+		mt == "application/xml",
+		mt == "application/x-www-form-urlencoded":
+		return utf8.Valid(body)
+	}
+	return false
+}
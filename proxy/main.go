@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -32,19 +33,14 @@ var (
 	functionName    = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
 	functionVersion = os.Getenv("AWS_LAMBDA_FUNCTION_VERSION")
 	inLambda        = functionName != "" && functionVersion != "" && os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
+	instanceID      string // random identifier of this sandbox
 
-	client = &http.Client{
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-		},
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
+	client *http.Client // client for requests to the user program, see newUpstreamClient
 )
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
+	instanceID = fmt.Sprintf("%016x", rand.Uint64())
 	// Generate a random port number between 19000 and 19999.
 	// This is to ensure the user program can't depend on hardcoded port numbers.
 	port = 19000 + int(time.Now().UnixNano()%1000)
@@ -52,6 +48,36 @@ func init() {
 	listen = "127.0.0.1:" + strconv.Itoa(port+1)
 }
 
+// newUpstreamClient returns the client for requests to the user program as
+// configured by the upstream settings. Redirects are passed back to the caller
+// rather than followed.
+func newUpstreamClient() *http.Client {
+	t := &http.Transport{
+		DisableKeepAlives:     !upstreamKeepAlive,
+		MaxIdleConns:          upstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   upstreamMaxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: upstreamResponseHeaderTimeout,
+	}
+	if upstreamTLS {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: upstreamTLSInsecure}
+	}
+	return &http.Client{
+		Transport: t,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// upstreamScheme returns the URL scheme of the user program.
+func upstreamScheme() string {
+	if upstreamTLS {
+		return "https"
+	}
+	return "http"
+}
+
 // handle is a generic handler for all Lambda events supported by this function.
 func handle(ctx context.Context, e map[string]json.RawMessage) (any, error) {
 
@@ -70,6 +96,8 @@ func handle(ctx context.Context, e map[string]json.RawMessage) (any, error) {
 			log.Printf("failed to unmarshal the SQS event: %v", err)
 			return nil, err
 		}
+		ctx, cancel := withDeadlineMargin(ctx)
+		defer cancel()
 		return handleSQS(ctx, sqsEvent)
 
 	} else if _, ok := e["rawQueryString"]; ok {
@@ -87,12 +115,30 @@ func handle(ctx context.Context, e map[string]json.RawMessage) (any, error) {
 		if err := json.Unmarshal(b, &cronEvent); err != nil {
 			log.Printf("failed to unmarshal the cron event: %v", err)
 		}
+		ctx, cancel := withDeadlineMargin(ctx)
+		defer cancel()
 		return nil, handleCron(ctx, cronEvent.Cron)
 	}
 
 	return nil, fmt.Errorf("event type %v not supported by this lambda function", e)
 }
 
+// withDeadlineMargin returns a context which expires a safety margin before
+// the lambda deadline of ctx. This leaves the proxy enough time to cancel
+// outstanding requests to the user program and report the results back to
+// lambda, rather than having lambda kill the whole invocation.
+func withDeadlineMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	margin := deadlineMargin
+	if q := time.Until(deadline) / 4; margin > q {
+		margin = q
+	}
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
 // run is the main entry point for the proxy.
 func run() (exitCode int, err error) {
 	if len(os.Args) < 2 {
@@ -100,6 +146,8 @@ func run() (exitCode int, err error) {
 	}
 	cmdName := os.Args[1]
 
+	loadConfig()
+
 	// Remove all env vars with lambdafy prefix to prevent child process from
 	// depending on them.
 	// IMPORTANT: This must come before startenv loading since none of the values
@@ -141,6 +189,9 @@ func run() (exitCode int, err error) {
 
 	// Start own AWS proxy endpoint (used for sending on SQS and other services)
 
+	if err := initSQSClient(context.Background()); err != nil {
+		log.Printf("error: failed to create SQS client - sending SQS messages will fail: %s", err)
+	}
 	http.HandleFunc("/sqs", handleSQSSend)
 	go http.ListenAndServe(listen, nil)
 
@@ -160,7 +211,7 @@ func run() (exitCode int, err error) {
 
 	// Pass through all signals to the child process
 
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	go func() {
 		for s := range sigs {
 			_ = cmd.Process.Signal(s)
@@ -189,6 +240,7 @@ func run() (exitCode int, err error) {
 	waitClient := &http.Client{
 		Transport: &http.Transport{
 			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: upstreamTLSInsecure},
 		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
@@ -199,7 +251,7 @@ func run() (exitCode int, err error) {
 
 StartupRequest:
 	for {
-		u := "http://" + appEndpoint + "/"
+		u := upstreamScheme() + "://" + appEndpoint + "/"
 		req, err := http.NewRequest(http.MethodGet, u, nil)
 		if err != nil {
 			return 1, fmt.Errorf("failed to create startup request: %s", err)
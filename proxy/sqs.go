@@ -2,17 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -33,10 +36,10 @@ func getSQSQueueURL(arn string) string {
 
 // handleSQS handles SQS events and translates them to HTTP requests to the user
 // program. The events are sent as POST requests to /_lambdafy/sqs with the SQS
-// event body as the HTTP payload. A 2xx/3xx response from the user program is
-// considered a success and the event is deleted from the queue. A non-2xx/3xx
-// response is considered a failure and the event is left in the queue for
-// retry.
+// event body as the HTTP payload (see newSQSRequest). A 2xx/3xx response from
+// the user program is considered a success and the event is deleted from the
+// queue. A non-2xx/3xx response is considered a failure and the event is left
+// in the queue for retry.
 func handleSQS(ctx context.Context, e events.SQSEvent) (resp events.SQSEventResponse, err error) {
 
 	log.Printf("processing batch of %d SQS records", len(e.Records))
@@ -47,45 +50,29 @@ func handleSQS(ctx context.Context, e events.SQSEvent) (resp events.SQSEventResp
 	}
 	taskResults := make(chan taskResult)
 
-	// Make n simultaneous requests to the user program to process the SQS records
-	// in the batch. To avoid overwhelming the user program, ensure the trigger is
-	// configured with small batch sizes.
+	// Process the records in the batch with a pool of workers making
+	// simultaneous requests to the user program. By default, there is one
+	// worker per record. To avoid overwhelming the user program, either
+	// configure the trigger with small batch sizes or limit the workers with
+	// LAMBDAFY_SQS_CONCURRENCY.
 
-	for _, r := range e.Records {
-		go func(r events.SQSMessage) {
-
-			err := func() error {
-				// Build standard HTTP request from the SQS event
-
-				u, _ := url.Parse(fmt.Sprintf("http://%s/_lambdafy/sqs", appEndpoint))
-				req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(r.Body))
-				if err != nil {
-					return fmt.Errorf("error creating HTTP request: %v", err)
-				}
-				req.Header.Add("Content-Length", strconv.Itoa(len(r.Body)))
-				resp, err := client.Do(req)
-				if err != nil {
-					return fmt.Errorf("error sending HTTP request: %v", err)
-				}
-				defer resp.Body.Close()
-
-				// Success
-
-				if resp.StatusCode >= 200 && resp.StatusCode < 400 {
-					return nil
-				}
-
-				// Failure
-
-				b, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					return fmt.Errorf("error reading response body: %v", err)
-				}
-				return fmt.Errorf("non-2xx/3xx response: %s", string(b))
-			}()
-			taskResults <- taskResult{msgID: r.MessageId, err: err}
-
-		}(r)
+	workers := len(e.Records)
+	if sqsConcurrency > 0 && sqsConcurrency < workers {
+		workers = sqsConcurrency
+	}
+	records := make(chan events.SQSMessage)
+	go func() {
+		defer close(records)
+		for _, r := range e.Records {
+			records <- r
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for r := range records {
+				taskResults <- taskResult{msgID: r.MessageId, err: processSQSRecord(ctx, r)}
+			}
+		}()
 	}
 
 	for range e.Records {
@@ -99,33 +86,181 @@ func handleSQS(ctx context.Context, e events.SQSEvent) (resp events.SQSEventResp
 		})
 	}
 
+	// Failures are reported per record so that only the failed records are
+	// retried. Returning an error would cause the whole batch to be retried.
+
 	if len(resp.BatchItemFailures) > 0 {
-		return resp, fmt.Errorf("some requests failed")
+		log.Printf("%d of %d SQS records failed", len(resp.BatchItemFailures), len(e.Records))
 	}
 	return resp, nil
 }
 
-type sqsSendDerefer map[string]string
+// processSQSRecord sends a single SQS record to the user program, limited to
+// LAMBDAFY_SQS_RECORD_TIMEOUT if set. Records which are not sent before ctx
+// expires are failed without being sent.
+func processSQSRecord(ctx context.Context, r events.SQSMessage) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("not processed as lambda deadline is near: %v", ctx.Err())
+	}
+	if sqsRecordTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sqsRecordTimeout)
+		defer cancel()
+	}
+
+	req, err := newSQSRequest(ctx, r)
+	if err != nil {
+		return fmt.Errorf("error creating HTTP request: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Success
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+		return nil
+	}
+
+	// Failure
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %v", err)
+	}
+	return fmt.Errorf("non-2xx/3xx response: %s", string(b))
+}
+
+// Headers used to pass SQS message metadata to the user program.
+const (
+	sqsMessageIDHeader       = "Lambdafy-SQS-Message-Id"
+	sqsReceiveCountHeader    = "Lambdafy-SQS-Receive-Count"
+	sqsSentTimestampHeader   = "Lambdafy-SQS-Sent-Timestamp"
+	sqsDeduplicationIDHeader = "Lambdafy-SQS-Deduplication-Id"
+	sqsQueueARNHeader        = "Lambdafy-SQS-Queue-Arn"
+	sqsAttrHeaderPrefix      = "Lambdafy-SQS-Attr-"
+)
+
+// newSQSRequest builds the HTTP request to the user program for the given SQS
+// message. Message metadata is passed in Lambdafy-SQS-* headers. Message
+// attributes are passed in Lambdafy-SQS-Attr-<name> headers, with binary
+// values base64 encoded. In envelope mode, the body is the JSON encoded message
+// including all its metadata, instead of just the message body.
+func newSQSRequest(ctx context.Context, m events.SQSMessage) (*http.Request, error) {
+	body := m.Body
+	if sqsEnvelope {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		body = string(b)
+	}
+
+	u, _ := url.Parse(fmt.Sprintf("%s://%s/_lambdafy/sqs", upstreamScheme(), appEndpoint))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(body)))
+	if sqsEnvelope {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	req.Header.Set(sqsMessageIDHeader, m.MessageId)
+	req.Header.Set(sqsQueueARNHeader, m.EventSourceARN)
+	for attr, h := range map[string]string{
+		"ApproximateReceiveCount": sqsReceiveCountHeader,
+		"SentTimestamp":           sqsSentTimestampHeader,
+		"MessageGroupId":          sqsGroupIDHeader,
+		"MessageDeduplicationId":  sqsDeduplicationIDHeader,
+	} {
+		if v, ok := m.Attributes[attr]; ok {
+			req.Header.Set(h, v)
+		}
+	}
+	for k, a := range m.MessageAttributes {
+		switch {
+		case a.StringValue != nil:
+			// Values that cannot be passed as headers are only available in
+			// envelope mode.
+			if strings.ContainsAny(*a.StringValue, "\r\n\x00") {
+				continue
+			}
+			req.Header.Set(sqsAttrHeaderPrefix+k, *a.StringValue)
+		case a.BinaryValue != nil:
+			req.Header.Set(sqsAttrHeaderPrefix+k, base64.StdEncoding.EncodeToString(a.BinaryValue))
+		}
+	}
+
+	return req, nil
+}
+
+// sqsSendRegistryMaxSize is the maximum number of queues that can be
+// registered for sending.
+const sqsSendRegistryMaxSize = 1000
+
+var sqsSendIDPat = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// sqsSendRegistry maps randomly generated IDs to queue URLs. Random IDs ensure
+// the user program cannot rely on the URL staying the same over time. It is
+// safe for concurrent use.
+type sqsSendRegistry struct {
+	mu   sync.RWMutex
+	urls map[string]string
+}
 
 // Deref generates a new random ID and maps it to the queue URL of the given SQS
-// ARN, and adds it to the map. It returns a URL that the user program can use
-// to send messages to the queue.
-func (d sqsSendDerefer) Deref(arn string) (string, error) {
-	// Generate a random string ID.
-	id := make([]byte, 16)
-	_, _ = rand.Read(id)
-	idStr := hex.EncodeToString(id)
+// ARN, and adds it to the registry. It returns a URL that the user program can
+// use to send messages to the queue.
+func (d *sqsSendRegistry) Deref(arn string) (string, error) {
 	qURL := getSQSQueueURL(arn)
 	if qURL == "" {
 		return "", fmt.Errorf("invalid SQS ARN: %s", arn)
 	}
-	d[idStr] = qURL
+	// Generate a random string ID.
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate SQS send ID: %s", err)
+	}
+	idStr := hex.EncodeToString(id)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.urls) >= sqsSendRegistryMaxSize {
+		return "", fmt.Errorf("too many SQS send queues (max %d)", sqsSendRegistryMaxSize)
+	}
+	d.urls[idStr] = qURL
 	return fmt.Sprintf("http://%s/sqs?id=%s", listen, idStr), nil
 }
 
-// sqsIdToQueueURL maps randomly generated IDs to queue URLs. Random IDs
-// ensure the user program cannot rely on the URL staying the same over time.
-var sqsIDToQueueURL = sqsSendDerefer{}
+// lookup returns the queue URL for the given ID.
+func (d *sqsSendRegistry) lookup(id string) (string, bool) {
+	if !sqsSendIDPat.MatchString(id) {
+		return "", false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	qURL, ok := d.urls[id]
+	return qURL, ok
+}
+
+var sqsIDToQueueURL = &sqsSendRegistry{urls: map[string]string{}}
+
+// sqsClient is used to send SQS messages on behalf of the user program. It's
+// created once at startup. See initSQSClient.
+var sqsClient *sqs.Client
+
+// initSQSClient creates the SQS client used for sending messages.
+func initSQSClient(ctx context.Context) error {
+	c, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sqsClient = sqs.NewFromConfig(c)
+	return nil
+}
 
 const sqsGroupIDHeader = "Lambdafy-SQS-Group-Id"
 
@@ -143,7 +278,7 @@ func handleSQSSend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	qURL, ok := sqsIDToQueueURL[qID]
+	qURL, ok := sqsIDToQueueURL.lookup(qID)
 	if !ok {
 		http.Error(w, "Invalid queue ID", http.StatusBadRequest)
 		return
@@ -160,15 +295,12 @@ func handleSQSSend(w http.ResponseWriter, r *http.Request) {
 		groupID = &g
 	}
 
-	c, err := awsconfig.LoadDefaultConfig(context.Background())
-	if err != nil {
-		log.Printf("error loading AWS config: %v", err)
-		http.Error(w, fmt.Sprintf("Error loading AWS config: %v", err), http.StatusInternalServerError)
+	if sqsClient == nil {
+		http.Error(w, "SQS client is not available - see proxy logs", http.StatusInternalServerError)
 		return
 	}
-	sqsCl := sqs.NewFromConfig(c)
 
-	if _, err := sqsCl.SendMessage(context.Background(), &sqs.SendMessageInput{
+	if _, err := sqsClient.SendMessage(r.Context(), &sqs.SendMessageInput{
 		MessageBody:    aws.String(string(body)),
 		QueueUrl:       aws.String(qURL),
 		MessageGroupId: groupID,
@@ -5,21 +5,26 @@ import (
 	"crypto/md5"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/accessanalyzer"
+	aatypes "github.com/aws/aws-sdk-go-v2/service/accessanalyzer/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/spf13/cobra"
 
 	"github.com/mathspace/lambdafy/fnspec"
@@ -67,6 +72,28 @@ const (
 	generatedRolePrefix = "lambdafy-v1-"
 )
 
+// encodeCronEnv encodes a cron trigger into an env var value. Plain cron
+// expressions are used when possible for compatibility with older versions.
+func encodeCronEnv(c *fnspec.CronTrigger) string {
+	if c.Enabled == nil && c.Description == "" {
+		return c.Schedule
+	}
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
+// decodeCronEnv decodes a cron trigger encoded by encodeCronEnv.
+func decodeCronEnv(v string) (*fnspec.CronTrigger, error) {
+	if !strings.HasPrefix(v, "{") {
+		return &fnspec.CronTrigger{Schedule: v}, nil
+	}
+	var c fnspec.CronTrigger
+	if err := json.Unmarshal([]byte(v), &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 var defaultAssumeRolePolicy = `{
   "Version": "2012-10-17",
   "Statement": [
@@ -87,8 +114,10 @@ var defaultAssumeRolePolicy = `{
 func init() {
 	var al string
 	var vars *[]string
+	var varFiles []string
 	var forceUpdateAlias bool
 	var pauseSQSTriggers bool
+	var opts publishOptions
 	publishCmd = &cobra.Command{
 		Use:     "publish {spec-file|-}",
 		Aliases: []string{"pub"},
@@ -99,6 +128,9 @@ func init() {
 			if pauseSQSTriggers {
 				return fmt.Errorf("pause-sqs-triggers is not yet implemented")
 			}
+			if al != "" && (len(al) > 128 || !aliasPat.MatchString(al)) {
+				return fmt.Errorf("invalid alias name: '%s' - must be at most 128 characters and match '%s'", al, aliasPatStr)
+			}
 
 			p := args[0]
 			var r io.Reader
@@ -113,8 +145,18 @@ func init() {
 				r = f
 			}
 
-			// Convert vars to map
+			// Convert vars to map. Vars given by flags override the ones in
+			// var files, and later var files override earlier ones.
 			varMap := make(map[string]string)
+			for _, f := range varFiles {
+				fileVars, err := loadVarFile(f)
+				if err != nil {
+					return err
+				}
+				for k, v := range fileVars {
+					varMap[k] = v
+				}
+			}
 			for _, v := range *vars {
 				parts := strings.SplitN(v, "=", 2)
 				if len(parts) != 2 {
@@ -123,12 +165,15 @@ func init() {
 				varMap[parts[0]] = parts[1]
 			}
 
-			out, err := publish(r, varMap)
+			out, err := publish(c.Context(), r, varMap, opts)
 			if err != nil {
 				return err
 			}
+			if opts.DryRun {
+				return nil
+			}
 			if al != "" {
-				err = alias(out.Name, out.Version, al, forceUpdateAlias)
+				err = alias(c.Context(), out.Name, out.Version, al, forceUpdateAlias)
 				if err != nil {
 					return fmt.Errorf("failed to create alias: %s", err)
 				}
@@ -146,6 +191,22 @@ func init() {
 	publishCmd.Flags().BoolVarP(&forceUpdateAlias, "force-update-alias", "A", false, "Force update the alias if already exists")
 	publishCmd.Flags().BoolVar(&pauseSQSTriggers, "pause-sqs-triggers", false, "Do not enable SQS triggers when publishing the function")
 	vars = publishCmd.Flags().StringArrayP("var", "v", nil, "Replace placeholders in the spec - e.g. FOO=BAR - can be specified multiple times")
+	publishCmd.Flags().StringArrayVar(&varFiles, "var-file", nil, "YAML, JSON or dotenv (any other extension) file of vars - can be specified multiple times")
+	publishCmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "Validate the spec, image and role policy without making or changing anything")
+	publishCmd.Flags().StringArrayVar(&opts.AgeIdentities, "age-identity", nil, "File with age identities to decrypt spec values with (default: $SOPS_AGE_KEY_FILE) - can be specified multiple times")
+	addScanGateFlags(publishCmd, &opts.ScanGate)
+}
+
+// publishOptions controls how a function is published.
+type publishOptions struct {
+	// ScanGate is the vulnerability scan gate the image must pass.
+	ScanGate scanGateOptions
+	// DryRun stops publishing before making or changing anything. Images that
+	// need to be made and pushed are not validated.
+	DryRun bool
+	// AgeIdentities are the files with the age identities to decrypt the
+	// encrypted values of the spec with.
+	AgeIdentities []string
 }
 
 // publishResult holds the results of a publish operation.
@@ -157,13 +218,126 @@ type publishResult struct {
 
 var roleArnPat = regexp.MustCompile(`^arn:aws:iam::\d+:role/.+`)
 
+// ecrImagePat matches ECR image URIs and captures the account, region,
+// repository name, tag and digest.
+var ecrImagePat = regexp.MustCompile(`^(\d+)\.dkr\.ecr\.([^.]+)\.amazonaws\.com/([^:@]+)(?::([^@]+))?(?:@(sha256:[0-9a-f]+))?$`)
+
+// defaultImageTag is the tag of image URIs with neither a tag nor a digest, as
+// with docker.
+const defaultImageTag = "latest"
+
+// validateImage ensures the given ECR image exists and can be pulled by lambda
+// in the given account and region.
+func validateImage(ctx context.Context, ecrCl *ecr.Client, image string, account string, region string) error {
+	m := ecrImagePat.FindStringSubmatch(image)
+	if m == nil {
+		return errors.New("not a valid ECR image URI")
+	}
+	imgAccount, imgRegion, repoName, tag, digest := m[1], m[2], m[3], m[4], m[5]
+	if imgRegion != region {
+		return fmt.Errorf("image is in region '%s' but lambda requires it to be in the same region as the function ('%s')", imgRegion, region)
+	}
+
+	if tag == "" {
+		tag = defaultImageTag
+	}
+	imgID := ecrtypes.ImageIdentifier{}
+	if digest != "" {
+		imgID.ImageDigest = &digest
+	} else {
+		imgID.ImageTag = &tag
+	}
+	if _, err := ecrCl.DescribeImages(ctx, &ecr.DescribeImagesInput{
+		RegistryId:     &imgAccount,
+		RepositoryName: &repoName,
+		ImageIds:       []ecrtypes.ImageIdentifier{imgID},
+	}); err != nil {
+		switch apiErrorCode(err) {
+		case "RepositoryNotFoundException":
+			return fmt.Errorf("repository '%s' does not exist in account %s", repoName, imgAccount)
+		case "ImageNotFoundException":
+			if digest != "" {
+				return fmt.Errorf("digest '%s' not found in repository '%s'", digest, repoName)
+			}
+			return fmt.Errorf("tag '%s' not found in repository '%s'", tag, repoName)
+		case "AccessDeniedException":
+			log.Printf("warning: cannot verify image exists in repository '%s': %s", repoName, err)
+		default:
+			return fmt.Errorf("failed to describe image: %s", err)
+		}
+	}
+
+	// Lambda grants itself pull access to repositories in the same account but
+	// repositories in other accounts must explicitly allow it.
+
+	if imgAccount == account {
+		return nil
+	}
+	pol, err := ecrCl.GetRepositoryPolicy(ctx, &ecr.GetRepositoryPolicyInput{
+		RegistryId:     &imgAccount,
+		RepositoryName: &repoName,
+	})
+	if err != nil {
+		if apiErrorCode(err) == "RepositoryPolicyNotFoundException" {
+			return fmt.Errorf("repository '%s' in account %s has no policy allowing lambda in account %s to pull from it", repoName, imgAccount, account)
+		}
+		log.Printf("warning: cannot verify repository policy of '%s' allows lambda to pull from it: %s", repoName, err)
+		return nil
+	}
+	for _, a := range []string{"ecr:BatchGetImage", "ecr:GetDownloadUrlForLayer"} {
+		if !strings.Contains(*pol.PolicyText, a) && !strings.Contains(*pol.PolicyText, "ecr:*") {
+			return fmt.Errorf("policy of repository '%s' in account %s does not allow '%s'", repoName, imgAccount, a)
+		}
+	}
+	return nil
+}
+
+// resolveImageDigest returns the digest of the image with the given tag.
+func resolveImageDigest(ctx context.Context, ecrCl *ecr.Client, registry string, repoName string, tag string) (string, error) {
+	if tag == "" {
+		tag = defaultImageTag
+	}
+	out, err := ecrCl.DescribeImages(ctx, &ecr.DescribeImagesInput{
+		RegistryId:     &registry,
+		RepositoryName: &repoName,
+		ImageIds:       []ecrtypes.ImageIdentifier{{ImageTag: &tag}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe image: %s", err)
+	}
+	if len(out.ImageDetails) == 0 {
+		return "", fmt.Errorf("tag '%s' not found in repository '%s'", tag, repoName)
+	}
+	return *out.ImageDetails[0].ImageDigest, nil
+}
+
+// pinImageDigest returns the given ECR image URI with its tag replaced by the
+// digest it currently points to. Images already pinned are returned as is.
+func pinImageDigest(ctx context.Context, ecrCl *ecr.Client, image string) (string, error) {
+	m := ecrImagePat.FindStringSubmatch(image)
+	if m == nil {
+		return "", errors.New("not a valid ECR image URI")
+	}
+	if m[5] != "" {
+		return image, nil
+	}
+	digest, err := resolveImageDigest(ctx, ecrCl, m[1], m[3], m[4])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s@%s", m[1], m[2], m[3], digest), nil
+}
+
 // publish publishes the lambda function to AWS.
-func publish(specReader io.Reader, vars map[string]string) (res publishResult, err error) {
+func publish(ctx context.Context, specReader io.Reader, vars map[string]string, opts publishOptions) (res publishResult, err error) {
 	spec, err := fnspec.Load(specReader, vars)
 	if err != nil {
 		return res, fmt.Errorf("failed to load function spec: %s", err)
 	}
 	res.Name = spec.Name
+	if err := decryptSpecEnv(ctx, spec, opts.AgeIdentities); err != nil {
+		return res, err
+	}
 
 	// HACK add CORS config to env vars so it can be used when deploying.
 
@@ -177,28 +351,38 @@ func publish(specReader io.Reader, vars map[string]string) (res publishResult, e
 	}
 	spec.Env[specInEnvPrefix+"CORS"] = string(corsBytes)
 
+	// HACK same for the URL auth type which is set on the function URL when
+	// deploying.
+
+	if spec.URLAuth != fnspec.URLAuthNone {
+		spec.Env[specInEnvPrefix+"URL_AUTH"] = spec.URLAuth
+	}
+
 	// HACK embed the cron setting into env vars so they can be used by deploy
 	// process to create the schedules. This simply passes the responsility of
 	// creating/updating the schedules to the deploy process.
 
 	if spec.CronTriggers != nil && len(spec.CronTriggers) > 0 {
 		for k, v := range spec.CronTriggers {
-			spec.Env[specInEnvCronPrefix+k] = v
+			spec.Env[specInEnvCronPrefix+k] = encodeCronEnv(v)
 		}
 	}
 
-	ctx := context.Background()
+	if n := fnspec.EnvSize(spec.Env); n > fnspec.MaxEnvSize {
+		return res, fmt.Errorf("env must be at most %d bytes in total but is %d bytes including the CORS and cron settings lambdafy stores in it", fnspec.MaxEnvSize, n)
+	}
 
 	// Setup clients
 
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return res, fmt.Errorf("failed to load aws config: %s", err)
 	}
+	acfg := clients.config()
 
 	// Is the region allowed by spec?
 
-	stsCl := sts.NewFromConfig(acfg)
+	stsCl := clients.sts()
 	cid, err := stsCl.GetCallerIdentity(ctx, nil)
 	if err != nil {
 		return res, fmt.Errorf("failed to get aws account number: %s", err)
@@ -207,33 +391,19 @@ func publish(specReader io.Reader, vars map[string]string) (res publishResult, e
 		return res, fmt.Errorf("aws account and/or region is not allowed by spec")
 	}
 
-	// If VPC config is specified, ensure that at least one egress rule is specified.
+	// If VPC config is specified, ensure that the function can reach the AWS
+	// services it needs.
 
-	if len(spec.VPCSecurityGroupIds) > 0 || len(spec.VPCSubnetIds) > 0 {
-		hasEgress := false
-		hasAllEgress := false
-
-		ec2Cl := ec2.NewFromConfig(acfg)
-		sgDetails, err := ec2Cl.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
-			GroupIds: spec.VPCSecurityGroupIds,
-		})
+	if (len(spec.VPCSecurityGroupIds) > 0 || len(spec.VPCSubnetIds) > 0) && spec.EgressCheck != fnspec.EgressCheckOff {
+		problems, err := checkEgress(ctx, clients.ec2(), spec, acfg.Region)
 		if err != nil {
-			return res, fmt.Errorf("failed to lookup security groups: %s", err)
-		}
-		for _, sg := range sgDetails.SecurityGroups {
-			for _, rule := range sg.IpPermissionsEgress {
-				hasEgress = true
-				if rule.IpProtocol != nil && *rule.IpProtocol == "-1" {
-					hasAllEgress = true
-				}
-			}
+			return res, err
 		}
-
-		if !hasEgress {
-			return res, fmt.Errorf("VPC config is set in your spec, but no outbound/egress rules specified")
+		if len(problems) > 0 && spec.EgressCheck == fnspec.EgressCheckError {
+			return res, fmt.Errorf("egress check failed (set egress_check to 'warn' or 'off' to ignore):\n  - %s", strings.Join(problems, "\n  - "))
 		}
-		if !hasAllEgress {
-			log.Printf("warning: VPC config is set in your spec, but no outbound/egress rules allow all traffic - you need this to be able to send logs to Cloudwatch")
+		for _, p := range problems {
+			log.Printf("warning: %s", p)
 		}
 	}
 
@@ -246,38 +416,85 @@ func publish(specReader io.Reader, vars map[string]string) (res publishResult, e
 
 	// Make and push if necessary
 
-	if spec.MakeAndPush() {
+	skipImage := opts.DryRun && spec.MakeAndPush()
+	if skipImage {
+		log.Printf("dry run - not lambdafying and pushing image '%s'", spec.Image)
+	} else if spec.MakeAndPush() {
 		log.Printf("lambdafying image '%s' and pushing", spec.Image)
 		var err error
-		if err = lambdafyImage(spec.Image); err != nil {
+		if err = lambdafyImage(ctx, spec.Image, provenance{}); err != nil {
 			return res, fmt.Errorf("failed to lambdafy image: %s", err)
 		}
-		spec.Image, err = push(spec.Image, spec.RepoName, *spec.CreateRepo)
+		spec.Image, err = push(ctx, spec.Image, spec.RepoName, *spec.CreateRepo, repoOptions{
+			KMSKey:        spec.RepoKMSKey,
+			ImmutableTags: spec.RepoImmutableTags,
+		})
 		if err != nil {
 			return res, fmt.Errorf("failed to push image: %s", err)
 		}
 	}
 
-	var roleArn string
-	iamCl := iam.NewFromConfig(acfg)
-
-	if spec.Role == fnspec.RoleGenerate {
+	// Ensure lambda will be able to pull the image before creating anything.
 
-		log.Printf("generating role")
+	if !skipImage {
+		ecrCl := clients.ecr()
+		if err := validateImage(ctx, ecrCl, spec.Image, *cid.Account, acfg.Region); err != nil {
+			return res, fmt.Errorf("invalid image '%s': %s", spec.Image, err)
+		}
+		if spec.RequireDigest {
+			pinned, err := pinImageDigest(ctx, ecrCl, spec.Image)
+			if err != nil {
+				return res, fmt.Errorf("failed to pin image '%s' to its digest: %s", spec.Image, err)
+			}
+			spec.Image = pinned
+		}
+		if _, err := checkScanGate(ctx, clients, spec.Image, opts.ScanGate); err != nil {
+			return res, err
+		}
+	}
 
-		// Serialize policy into JSON string
+	// Serialize and validate the generated role policy.
 
-		pol, err := serializeRolePolicy(spec.RoleExtraPolicy)
+	var canPol string
+	if spec.Role == fnspec.RoleGenerate {
+		pol, err := serializeRolePolicy(rolePolicyStatements(spec, *cid.Account, acfg.Region))
 		if err != nil {
 			return res, fmt.Errorf("failed to serialize role policy: %s", err)
 		}
-		canPol, _ := canonicalizePolicyString(pol, false)
-		roleName := fmt.Sprintf("%s%x", generatedRolePrefix, md5.Sum([]byte(defaultAssumeRolePolicy+canPol)))
+		canPol, _ = canonicalizePolicyString(pol, false)
+		if err := validateRolePolicy(ctx, clients.accessAnalyzer(), canPol); err != nil {
+			return res, err
+		}
+	}
+
+	if opts.DryRun {
+		log.Printf("dry run - stopping before making any changes")
+		return res, nil
+	}
+
+	var roleArn string
+	iamCl := clients.iam()
+
+	if spec.Role == fnspec.RoleGenerate {
+
+		log.Printf("generating role")
+
+		roleName := spec.RoleNamePrefix + generatedRolePrefix + generatedRoleHash(canPol, spec.RolePath, spec.RoleTags)
 
 		// Create/update role
 
+		var roleTags []iamtypes.Tag
+		for k, v := range spec.RoleTags {
+			roleTags = append(roleTags, iamtypes.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		var rolePath *string
+		if spec.RolePath != "" {
+			rolePath = &spec.RolePath
+		}
 		out, err := iamCl.CreateRole(ctx, &iam.CreateRoleInput{
 			RoleName:                 &roleName,
+			Path:                     rolePath,
+			Tags:                     roleTags,
 			Description:              aws.String("lambdafy generated role"),
 			AssumeRolePolicyDocument: &defaultAssumeRolePolicy,
 		})
@@ -336,7 +553,7 @@ func publish(specReader io.Reader, vars map[string]string) (res publishResult, e
 		}
 	}
 
-	lambdaCl := lambda.NewFromConfig(acfg)
+	lambdaCl := clients.lambda()
 	fn, err := lambdaCl.GetFunction(ctx, &lambda.GetFunctionInput{
 		FunctionName: aws.String(spec.Name),
 	})
@@ -386,6 +603,15 @@ func publish(specReader io.Reader, vars map[string]string) (res publishResult, e
 
 		log.Printf("updating existing function '%s'", spec.Name)
 
+		if diff := configDiff(fn, spec, roleArn, tags); len(diff) > 0 {
+			log.Printf("changes since last published version:")
+			for _, d := range diff {
+				log.Printf("  %s", d)
+			}
+		} else {
+			log.Printf("no configuration changes since last published version")
+		}
+
 		// Update function config
 
 		ctxTo, cancel := context.WithTimeout(ctx, 10*time.Minute)
@@ -467,6 +693,9 @@ func publish(specReader io.Reader, vars map[string]string) (res publishResult, e
 
 		oldTags := []string{}
 		for k := range fn.Tags {
+			if k == scanGateBypassTag {
+				continue
+			}
 			if _, ok := tags[k]; !ok {
 				oldTags = append(oldTags, k)
 			}
@@ -483,17 +712,362 @@ func publish(specReader io.Reader, vars map[string]string) (res publishResult, e
 
 	}
 
+	if err := reconcileInvokePermissions(ctx, lambdaCl, spec); err != nil {
+		return res, err
+	}
+
 	log.Printf("waiting for the new function version to become ready")
 
 	return res, waitOnFunc(ctx, lambdaCl, spec.Name, res.Version)
 }
 
+// configDiff returns a human readable list of differences between the
+// configuration of the existing function and the one about to be published.
+// Env values are not included as they may be sensitive.
+func configDiff(fn *lambda.GetFunctionOutput, spec *fnspec.Spec, roleArn string, tags map[string]string) []string {
+	var diff []string
+	cfg := fn.Configuration
+
+	change := func(name string, old string, new string) {
+		if old != new {
+			diff = append(diff, fmt.Sprintf("%s %s -> %s", name, old, new))
+		}
+	}
+	strOf := func(s *string) string {
+		if s == nil {
+			return "<none>"
+		}
+		return *s
+	}
+	intOf := func(i *int32) string {
+		if i == nil {
+			return "<none>"
+		}
+		return strconv.Itoa(int(*i))
+	}
+	listOf := func(l []string) string {
+		if len(l) == 0 {
+			return "<none>"
+		}
+		return fmt.Sprintf("%q", l)
+	}
+	sortedList := func(l []string) string {
+		c := append([]string{}, l...)
+		sort.Strings(c)
+		return listOf(c)
+	}
+
+	if fn.Code != nil {
+		change("image", strOf(fn.Code.ImageUri), spec.Image)
+	}
+	change("description", fmt.Sprintf("%q", strOf(cfg.Description)), fmt.Sprintf("%q", spec.Description))
+	change("role", strOf(cfg.Role), roleArn)
+	if spec.Memory != nil {
+		change("memory", intOf(cfg.MemorySize), intOf(spec.Memory))
+	}
+	if spec.Timeout != nil {
+		change("timeout", intOf(cfg.Timeout), intOf(spec.Timeout))
+	}
+
+	var oldImgCfg lambdatypes.ImageConfig
+	if cfg.ImageConfigResponse != nil && cfg.ImageConfigResponse.ImageConfig != nil {
+		oldImgCfg = *cfg.ImageConfigResponse.ImageConfig
+	}
+	change("entrypoint", listOf(oldImgCfg.EntryPoint), listOf(spec.Entrypoint))
+	change("command", listOf(oldImgCfg.Command), listOf(spec.Command))
+	change("workdir", strOf(oldImgCfg.WorkingDirectory), strOf(spec.WorkDir))
+
+	var oldSubnets, oldSGs []string
+	if cfg.VpcConfig != nil {
+		oldSubnets, oldSGs = cfg.VpcConfig.SubnetIds, cfg.VpcConfig.SecurityGroupIds
+	}
+	change("vpc_subnet_ids", sortedList(oldSubnets), sortedList(spec.VPCSubnetIds))
+	change("vpc_security_group_ids", sortedList(oldSGs), sortedList(spec.VPCSecurityGroupIds))
+
+	var oldMounts, newMounts []string
+	for _, m := range cfg.FileSystemConfigs {
+		oldMounts = append(oldMounts, fmt.Sprintf("%s:%s", *m.Arn, *m.LocalMountPath))
+	}
+	for _, m := range spec.EFSMounts {
+		newMounts = append(newMounts, fmt.Sprintf("%s:%s", m.ARN, m.Path))
+	}
+	change("efs_mounts", sortedList(oldMounts), sortedList(newMounts))
+
+	// Spec settings stored in env vars are reported under their spec names.
+
+	envName := func(k string) string {
+		switch {
+		case k == specInEnvPrefix+"CORS":
+			return "cors"
+		case k == specInEnvPrefix+"URL_AUTH":
+			return "url_auth"
+		case strings.HasPrefix(k, specInEnvCronPrefix):
+			return "cron " + k[len(specInEnvCronPrefix):]
+		}
+		return "env " + k
+	}
+	oldEnv := map[string]string{}
+	if cfg.Environment != nil {
+		oldEnv = cfg.Environment.Variables
+	}
+	diff = append(diff, mapDiff(oldEnv, spec.Env, envName, false)...)
+	diff = append(diff, mapDiff(fn.Tags, tags, func(k string) string { return "tag " + k }, true)...)
+
+	return diff
+}
+
+// mapDiff returns the sorted list of keys added, removed and changed between
+// the old and new maps, named using name. Values are only included if
+// showValues is true.
+func mapDiff(old, new map[string]string, name func(string) string, showValues bool) []string {
+	var diff []string
+	for k, v := range new {
+		ov, ok := old[k]
+		switch {
+		case !ok:
+			diff = append(diff, name(k)+" added")
+		case ov != v && showValues:
+			diff = append(diff, fmt.Sprintf("%s changed %q -> %q", name(k), ov, v))
+		case ov != v:
+			diff = append(diff, name(k)+" changed")
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			diff = append(diff, name(k)+" removed")
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// sqsSendStarenvTag is the starenv derefer tag which the proxy uses to turn
+// SQS queue ARNs into URLs for sending messages to the queues.
+const sqsSendStarenvTag = "lambdafy_sqs_send"
+
+// envRefs returns the sorted unique references of env vars dereferenced by
+// starenv with any of the given tags. Only the innermost derefer of a pipeline
+// (e.g. ssm in "*b64*ssm:/foo") sees the reference as written.
+func envRefs(env map[string]string, tags ...string) []string {
+	seen := map[string]bool{}
+	var refs []string
+	for _, v := range env {
+		if !strings.HasPrefix(v, "*") {
+			continue
+		}
+		i := strings.Index(v, ":")
+		if i < 0 {
+			continue
+		}
+		pipeline := strings.Split(v[1:i], "*")
+		innermost, ref := pipeline[len(pipeline)-1], v[i+1:]
+		for _, t := range tags {
+			if innermost == t && !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// ssmParamRefPat matches the references of the starenv ssm derefers and
+// captures the optional region and account, and the parameter name.
+var ssmParamRefPat = regexp.MustCompile(`^(?:arn:aws:ssm:([^:]+):([^:]*):parameter)?(/.+)$`)
+
+// ssmParamARNs returns the ARNs of the SSM parameters referenced by the env
+// vars. Parameters without a region or account default to the given ones.
+func ssmParamARNs(env map[string]string, account string, region string) []string {
+	var arns []string
+	for _, ref := range envRefs(env, "ssm", "pssm") {
+		m := ssmParamRefPat.FindStringSubmatch(ref)
+		if m == nil {
+			continue
+		}
+		r, a := m[1], m[2]
+		if r == "" {
+			r = region
+		}
+		if a == "" {
+			a = account
+		}
+		arns = append(arns, fmt.Sprintf("arn:aws:ssm:%s:%s:parameter%s", r, a, m[3]))
+	}
+	sort.Strings(arns)
+	return arns
+}
+
+// ssmDecryptServices returns the SSM service endpoints (as used in the
+// kms:ViaService condition key) of the parameters referenced in env which are
+// decrypted, i.e. those referenced by the ssm derefer rather than pssm.
+func ssmDecryptServices(env map[string]string, region string) []string {
+	var services []string
+	for _, ref := range envRefs(env, "ssm") {
+		m := ssmParamRefPat.FindStringSubmatch(ref)
+		if m == nil {
+			continue
+		}
+		r := m[1]
+		if r == "" {
+			r = region
+		}
+		if s := fmt.Sprintf("ssm.%s.amazonaws.com", r); !containsString(services, s) {
+			services = append(services, s)
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+// rolePolicyStatements returns the policy statements of the generated role for
+// the given spec in the given account and region. Unless the spec asks for the
+// permissive policy, the statements are scoped to the function's own log
+// group, its SQS queues, the SSM parameters referenced in its env and itself.
+func rolePolicyStatements(spec *fnspec.Spec, account string, region string) []*fnspec.RolePolicy {
+	var policy []*fnspec.RolePolicy
+
+	if spec.RolePolicyMode == fnspec.RolePolicyPermissive {
+		policy = append(policy, defaultRolePolicyStatements...)
+		return append(policy, spec.RoleExtraPolicy...)
+	}
+
+	logGroupARN := fmt.Sprintf("arn:aws:logs:%s:%s:log-group:/aws/lambda/%s", region, account, spec.Name)
+	fnARN := fmt.Sprintf("arn:aws:lambda:%s:%s:function:%s", region, account, spec.Name)
+
+	policy = append(policy, &fnspec.RolePolicy{
+		Sid:      fnspec.GeneratedSidPrefix + "Logs",
+		Effect:   "Allow",
+		Action:   []string{"logs:CreateLogGroup", "logs:CreateLogStream", "logs:PutLogEvents"},
+		Resource: []string{logGroupARN, logGroupARN + ":*"},
+	})
+
+	// This is needed for Amazon Event Bridge Scheduler to call the function.
+	policy = append(policy, &fnspec.RolePolicy{
+		Sid:      fnspec.GeneratedSidPrefix + "Invoke",
+		Effect:   "Allow",
+		Action:   []string{"lambda:InvokeFunction"},
+		Resource: []string{fnARN, fnARN + ":*"},
+	})
+
+	if len(spec.SQSTriggers) > 0 {
+		var arns []string
+		for _, t := range spec.SQSTriggers {
+			arns = append(arns, t.ARN)
+		}
+		sort.Strings(arns)
+		policy = append(policy, &fnspec.RolePolicy{
+			Sid:      fnspec.GeneratedSidPrefix + "SQSReceive",
+			Effect:   "Allow",
+			Action:   []string{"sqs:DeleteMessage", "sqs:GetQueueAttributes", "sqs:ReceiveMessage"},
+			Resource: arns,
+		})
+	}
+
+	if arns := envRefs(spec.Env, sqsSendStarenvTag); len(arns) > 0 {
+		policy = append(policy, &fnspec.RolePolicy{
+			Sid:      fnspec.GeneratedSidPrefix + "SQSSend",
+			Effect:   "Allow",
+			Action:   []string{"sqs:SendMessage"},
+			Resource: arns,
+		})
+	}
+
+	if arns := ssmParamARNs(spec.Env, account, region); len(arns) > 0 {
+		policy = append(policy, &fnspec.RolePolicy{
+			Sid:      fnspec.GeneratedSidPrefix + "SSMParams",
+			Effect:   "Allow",
+			Action:   []string{"ssm:GetParameter"},
+			Resource: arns,
+		})
+	}
+
+	// SecureString parameters are decrypted with their KMS key. Keys are not
+	// known upfront so decrypting is allowed with any key, but only via SSM.
+	if services := ssmDecryptServices(spec.Env, region); len(services) > 0 {
+		policy = append(policy, &fnspec.RolePolicy{
+			Sid:      fnspec.GeneratedSidPrefix + "SSMDecrypt",
+			Effect:   "Allow",
+			Action:   []string{"kms:Decrypt"},
+			Resource: []string{"*"},
+			Condition: map[string]map[string]interface{}{
+				"StringEquals": {"kms:ViaService": services},
+			},
+		})
+	}
+
+	// ENI actions do not support resource level permissions.
+	if len(spec.VPCSubnetIds) > 0 || len(spec.VPCSecurityGroupIds) > 0 {
+		policy = append(policy, &fnspec.RolePolicy{
+			Sid:    fnspec.GeneratedSidPrefix + "VPC",
+			Effect: "Allow",
+			Action: []string{
+				"ec2:AssignPrivateIpAddresses",
+				"ec2:CreateNetworkInterface",
+				"ec2:DeleteNetworkInterface",
+				"ec2:DescribeNetworkInterfaces",
+				"ec2:UnassignPrivateIpAddresses",
+			},
+			Resource: []string{"*"},
+		})
+	}
+
+	return append(policy, spec.RoleExtraPolicy...)
+}
+
+// generatedRoleHash returns the hash used in the name of a generated role with
+// the given canonical policy, path and tags. Path and tags are part of the hash
+// since role names are unique regardless of them.
+func generatedRoleHash(canPol string, path string, tags map[string]string) string {
+	h := md5.New()
+	io.WriteString(h, defaultAssumeRolePolicy+canPol)
+	if path != "" && path != "/" {
+		io.WriteString(h, "\npath:"+path)
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		io.WriteString(h, "\ntag:"+k+"="+tags[k])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// validateRolePolicy checks the given role policy with IAM Access Analyzer.
+// Findings of type error fail the validation while the rest are logged as
+// warnings. Validation is skipped if Access Analyzer cannot be used.
+func validateRolePolicy(ctx context.Context, aaCl *accessanalyzer.Client, policy string) error {
+	var errs []string
+	pages := accessanalyzer.NewValidatePolicyPaginator(aaCl, &accessanalyzer.ValidatePolicyInput{
+		PolicyDocument: &policy,
+		PolicyType:     aatypes.PolicyTypeIdentityPolicy,
+	})
+	for pages.HasMorePages() {
+		p, err := pages.NextPage(ctx)
+		if err != nil {
+			log.Printf("warning: cannot validate role policy with IAM Access Analyzer: %s", err)
+			return nil
+		}
+		for _, f := range p.Findings {
+			msg := fmt.Sprintf("%s: %s", aws.ToString(f.IssueCode), aws.ToString(f.FindingDetails))
+			if f.FindingType == aatypes.ValidatePolicyFindingTypeError {
+				errs = append(errs, msg)
+				continue
+			}
+			log.Printf("warning: role policy %s %s", strings.ToLower(string(f.FindingType)), msg)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid role policy:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return nil
+}
+
 // serializeRolePolicy serializes the role policy statements into a JSON string,
 // in the format expected by AWS.
-func serializeRolePolicy(extra []*fnspec.RolePolicy) (string, error) {
-	var policy []*fnspec.RolePolicy
-	policy = append(policy, defaultRolePolicyStatements...)
-	policy = append(policy, extra...)
+func serializeRolePolicy(policy []*fnspec.RolePolicy) (string, error) {
 	w := strings.Builder{}
 	enc := json.NewEncoder(&w)
 	enc.SetIndent("", "  ")
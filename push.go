@@ -10,8 +10,8 @@ import (
 	"log"
 	"strings"
 
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
 	dockertypes "github.com/docker/docker/api/types"
 	dockerclient "github.com/docker/docker/client"
 	"github.com/spf13/cobra"
@@ -21,13 +21,14 @@ var pushCmd *cobra.Command
 
 func init() {
 	var create bool
+	var repoOpts repoOptions
 	pushCmd = &cobra.Command{
 		Use:   "push image-name[:tag] repo-name",
 		Short: "Pushes a docker image to a ECR repository",
 		Long:  "Pushes a docker image to a ECR repository. The pushed image URI is printed to stdout on success.",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(c *cobra.Command, args []string) error {
-			repoImage, err := push(args[0], args[1], create)
+			repoImage, err := push(c.Context(), args[0], args[1], create, repoOpts)
 			if err != nil {
 				return err
 			}
@@ -36,13 +37,77 @@ func init() {
 		},
 	}
 	pushCmd.Flags().BoolVarP(&create, "create", "c", false, "Create the repository if it doesn't exist")
+	pushCmd.Flags().StringVar(&repoOpts.KMSKey, "kms-key", "", "KMS key to encrypt the repository with when creating it")
+	pushCmd.Flags().BoolVar(&repoOpts.ImmutableTags, "immutable-tags", false, "Make tags of the repository immutable when creating it")
+}
+
+// repoOptions are the settings of ECR repositories created by push.
+type repoOptions struct {
+	// KMSKey is the ID, alias or ARN of the KMS key to encrypt the repository
+	// with. The AES256 encryption is used if empty.
+	KMSKey string
+	// ImmutableTags prevents tags from being overwritten.
+	ImmutableTags bool
+}
+
+// createRepositoryInput returns the input to create a repository with the
+// given name and options.
+func (o repoOptions) createRepositoryInput(repoName string) *ecr.CreateRepositoryInput {
+	in := &ecr.CreateRepositoryInput{
+		RepositoryName: &repoName,
+	}
+	if o.KMSKey != "" {
+		in.EncryptionConfiguration = &ecrtypes.EncryptionConfiguration{
+			EncryptionType: ecrtypes.EncryptionTypeKms,
+			KmsKey:         &o.KMSKey,
+		}
+	}
+	if o.ImmutableTags {
+		in.ImageTagMutability = ecrtypes.ImageTagMutabilityImmutable
+	}
+	return in
+}
+
+// checkRepository logs a warning for each setting of an existing repository
+// that does not match the options since push does not change existing
+// repositories.
+func (o repoOptions) checkRepository(repo ecrtypes.Repository) {
+	if o.KMSKey != "" && (repo.EncryptionConfiguration == nil || repo.EncryptionConfiguration.EncryptionType != ecrtypes.EncryptionTypeKms) {
+		log.Printf("warning: existing repository '%s' is not encrypted with a KMS key", *repo.RepositoryName)
+	}
+	if o.ImmutableTags && repo.ImageTagMutability != ecrtypes.ImageTagMutabilityImmutable {
+		log.Printf("warning: existing repository '%s' does not have immutable tags", *repo.RepositoryName)
+	}
+}
+
+// ecrLogin returns the docker registry credentials for the ECR registry of the
+// current account.
+func ecrLogin(ctx context.Context, ecrCl *ecr.Client) (dockertypes.AuthConfig, error) {
+	var authCfg dockertypes.AuthConfig
+	tokResp, err := ecrCl.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return authCfg, fmt.Errorf("failed to get ecr auth token: %s", err)
+	}
+	if len(tokResp.AuthorizationData) < 1 {
+		return authCfg, fmt.Errorf("missing ecr auth token")
+	}
+	authToken, err := base64.StdEncoding.DecodeString(*tokResp.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return authCfg, fmt.Errorf("failed to decode ecr auth token: %s", err)
+	}
+	authTokenParts := strings.SplitN(string(authToken), ":", 2)
+	if len(authTokenParts) != 2 {
+		return authCfg, errors.New("invalid ecr auth token")
+	}
+	authCfg.Username = authTokenParts[0]
+	authCfg.Password = authTokenParts[1]
+	authCfg.ServerAddress = *tokResp.AuthorizationData[0].ProxyEndpoint
+	return authCfg, nil
 }
 
 // push pushes a docker image to a ECR repository.
 // Returns the full ECR image URI.
-func push(imgName string, repoName string, create bool) (string, error) {
-
-	ctx := context.Background()
+func push(ctx context.Context, imgName string, repoName string, create bool, repoOpts repoOptions) (string, error) {
 
 	if strings.Contains(repoName, ":") {
 		return "", errors.New("repo-name cannot contain a tag - a unique tag is generated automatically")
@@ -58,11 +123,11 @@ func push(imgName string, repoName string, create bool) (string, error) {
 		return "", fmt.Errorf("failed to get docker client: %s", err)
 	}
 
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to load aws config: %s", err)
 	}
-	ecrCl := ecr.NewFromConfig(acfg)
+	ecrCl := clients.ecr()
 
 	// Get the image digest rehash it to MD5 for more compact representation.
 
@@ -82,33 +147,6 @@ func push(imgName string, repoName string, create bool) (string, error) {
 		return "", fmt.Errorf("platform of docker image '%s' must be linux/amd64", imgName)
 	}
 
-	log.Print("logging in to ECR")
-
-	tokResp, err := ecrCl.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
-	if err != nil {
-		return "", fmt.Errorf("failed to get ecr auth token: %s", err)
-	}
-	if len(tokResp.AuthorizationData) < 1 {
-		return "", fmt.Errorf("missing ecr auth token")
-	}
-	authToken, err := base64.StdEncoding.DecodeString(*tokResp.AuthorizationData[0].AuthorizationToken)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode ecr auth token: %s", err)
-	}
-	authTokenParts := strings.SplitN(string(authToken), ":", 2)
-	if len(authTokenParts) != 2 {
-		return "", errors.New("invalid ecr auth token")
-	}
-	regEP := *tokResp.AuthorizationData[0].ProxyEndpoint
-
-	authCfg := dockertypes.AuthConfig{
-		Username:      authTokenParts[0],
-		Password:      authTokenParts[1],
-		ServerAddress: regEP,
-	}
-	authCfgBytes, _ := json.Marshal(authCfg)
-	authCfgEncoded := base64.URLEncoding.EncodeToString(authCfgBytes)
-
 	// Get the ECR URI for the repo name
 
 	var repoURL string
@@ -121,9 +159,7 @@ func push(imgName string, repoName string, create bool) (string, error) {
 				return "", fmt.Errorf("repository '%s' not found", repoName)
 			}
 			log.Printf("creating repository '%s' in ECR", repoName)
-			_, err = ecrCl.CreateRepository(ctx, &ecr.CreateRepositoryInput{
-				RepositoryName: &repoName,
-			})
+			_, err = ecrCl.CreateRepository(ctx, repoOpts.createRepositoryInput(repoName))
 			if err != nil {
 				return "", fmt.Errorf("failed to create repository '%s': %s", repoName, err)
 			}
@@ -137,10 +173,37 @@ func push(imgName string, repoName string, create bool) (string, error) {
 		} else {
 			return "", fmt.Errorf("failed to describe repository '%s': %s", repoName, err)
 		}
+	} else {
+		repoOpts.checkRepository(o.Repositories[0])
 	}
 	repoURL = *o.Repositories[0].RepositoryUri
 	repoImage := repoURL + ":" + imgDigest
 
+	// Tags are derived from the image content, so if the tag is already in the
+	// repo the image has been pushed before and there's nothing to upload. Roles
+	// which can only push can't look images up so they push regardless.
+
+	if _, err := ecrCl.DescribeImages(ctx, &ecr.DescribeImagesInput{
+		RepositoryName: &repoName,
+		ImageIds:       []ecrtypes.ImageIdentifier{{ImageTag: &imgDigest}},
+	}); err == nil {
+		log.Printf("image is already in ECR - skipping push")
+		return repoImage, nil
+	} else if code := apiErrorCode(err); code == "AccessDeniedException" {
+		log.Printf("warning: cannot check if image is already in ECR - pushing anyway: %s", err)
+	} else if code != "ImageNotFoundException" {
+		return "", fmt.Errorf("failed to lookup image in repository '%s': %s", repoName, err)
+	}
+
+	log.Print("logging in to ECR")
+
+	authCfg, err := ecrLogin(ctx, ecrCl)
+	if err != nil {
+		return "", err
+	}
+	authCfgBytes, _ := json.Marshal(authCfg)
+	authCfgEncoded := base64.URLEncoding.EncodeToString(authCfgBytes)
+
 	log.Printf("tagging image")
 
 	dc.ImageTag(ctx, imgName, repoImage)
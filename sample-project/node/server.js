@@ -0,0 +1,30 @@
+const http = require("http");
+
+const server = http.createServer((req, res) => {
+  const url = new URL(req.url, "http://localhost");
+
+  if (url.pathname === "/_lambdafy/sqs") {
+    let body = "";
+    req.on("data", (chunk) => (body += chunk));
+    req.on("end", () => {
+      console.error("Received SQS message:", body);
+      res.end();
+    });
+    return;
+  }
+
+  if (url.pathname === "/_lambdafy/cron") {
+    console.error("Received cron trigger:", url.searchParams.get("name"));
+    res.end();
+    return;
+  }
+
+  console.error(`Received HTTP request at ${url.pathname}`);
+  res.setHeader("Content-Type", "text/plain");
+  res.end("Greetings from lambdafy.\n");
+});
+
+const port = parseInt(process.env.PORT || "8080", 10);
+server.listen(port, () => {
+  console.error(`Listening on port ${port} ...`);
+});
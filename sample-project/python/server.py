@@ -2,6 +2,7 @@ import os
 import sys
 from pprint import pprint
 from io import StringIO
+from urllib.parse import parse_qs
 from wsgiref.simple_server import make_server
 
 
@@ -14,6 +15,12 @@ def app(environ, start_response):
         print("Received SQS message:", body.getvalue(), file=sys.stderr)
         return [b""]
 
+    if environ["PATH_INFO"] == "/_lambdafy/cron":
+        start_response("200 OK", [("Content-Type", "text/html")])
+        name = parse_qs(environ.get("QUERY_STRING", "")).get("name", [""])[0]
+        print("Received cron trigger:", name, file=sys.stderr)
+        return [b""]
+
     start_response("200 OK", [("Content-Type", "text/plain")])
     print("Received HTTP request at %s" % environ["PATH_INFO"], file=sys.stderr)
     return [b"Greetings from lambdafy.\n"]
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+)
+
+// Supported SBOM formats.
+const (
+	sbomFormatCycloneDX = "cyclonedx"
+	sbomFormatSPDX      = "spdx"
+)
+
+// sbomMediaTypes are the media types of the SBOM formats when attached to
+// images.
+var sbomMediaTypes = map[string]string{
+	sbomFormatCycloneDX: "application/vnd.cyclonedx+json",
+	sbomFormatSPDX:      "application/spdx+json",
+}
+
+// sbomOptions controls how SBOMs are generated.
+type sbomOptions struct {
+	// Format is either sbomFormatCycloneDX or sbomFormatSPDX.
+	Format string
+	// Attach pushes the SBOM to the image repository as an OCI referrer of the
+	// image. Only supported for ECR images.
+	Attach bool
+}
+
+var sbomCmd = &cobra.Command{
+	Use:   "sbom",
+	Short: "Generate software bill of materials (SBOM) of images",
+	Long: `Generate software bill of materials (SBOM) of images, including the lambdafy
+proxy, and print it to stdout. Requires syft (https://github.com/anchore/syft)
+to be installed.`,
+}
+
+func init() {
+	var o sbomOptions
+
+	imageCmd := &cobra.Command{
+		Use:   "image image-name",
+		Short: "Generate SBOM of a local docker image or an ECR image",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			return sbom(c.Context(), args[0], o)
+		},
+	}
+
+	var ver string
+	functionCmd := &cobra.Command{
+		Use:   "function function-name",
+		Short: "Generate SBOM of the image of a function version",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			ctx := c.Context()
+			fnName := args[0]
+			version, err := resolveVersion(ctx, fnName, ver)
+			if err != nil {
+				return fmt.Errorf("failed to resolve version '%s': %s", ver, err)
+			}
+			clients, err := awsClientsFrom(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to load aws config: %s", err)
+			}
+			fn, err := clients.lambda().GetFunction(ctx, &lambda.GetFunctionInput{
+				FunctionName: &fnName,
+				Qualifier:    aws.String(strconv.Itoa(version)),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to get function: %s", err)
+			}
+			if fn.Code == nil || fn.Code.ResolvedImageUri == nil {
+				return fmt.Errorf("cannot find the image of version %d", version)
+			}
+			return sbom(ctx, *fn.Code.ResolvedImageUri, o)
+		},
+	}
+	addVersionFlag(functionCmd.Flags(), &ver)
+
+	for _, c := range []*cobra.Command{imageCmd, functionCmd} {
+		c.Flags().StringVar(&o.Format, "format", sbomFormatCycloneDX, "SBOM format: cyclonedx or spdx")
+		c.Flags().BoolVar(&o.Attach, "attach", false, "Attach the SBOM to the image in ECR as an OCI referrer")
+		sbomCmd.AddCommand(c)
+	}
+}
+
+// sbom generates the SBOM of the given image, prints it to stdout and
+// optionally attaches it to the image.
+func sbom(ctx context.Context, image string, o sbomOptions) error {
+	if _, ok := sbomMediaTypes[o.Format]; !ok {
+		return fmt.Errorf("--format must be either '%s' or '%s'", sbomFormatCycloneDX, sbomFormatSPDX)
+	}
+	if _, err := exec.LookPath("syft"); err != nil {
+		return fmt.Errorf("syft is required to generate SBOMs: %s", err)
+	}
+	isECR := ecrImagePat.MatchString(image)
+	if o.Attach && !isECR {
+		return fmt.Errorf("--attach is only supported for ECR images")
+	}
+
+	// Images in ECR are pinned to their digest so the SBOM and its attachment
+	// refer to the exact same image.
+
+	var ecrCl *ecr.Client
+	var labels map[string]string
+	source := "docker:" + image
+	syftEnv := os.Environ()
+	if isECR {
+		clients, err := awsClientsFrom(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load aws config: %s", err)
+		}
+		ecrCl = clients.ecr()
+		if image, err = pinImageDigest(ctx, ecrCl, image); err != nil {
+			return fmt.Errorf("failed to resolve digest of image: %s", err)
+		}
+		if labels, err = imageLabels(ctx, ecrCl, image); err != nil {
+			return fmt.Errorf("failed to get image labels: %s", err)
+		}
+		auth, err := ecrLogin(ctx, ecrCl)
+		if err != nil {
+			return err
+		}
+		source = "registry:" + image
+		syftEnv = append(syftEnv,
+			"SYFT_REGISTRY_AUTH_AUTHORITY="+strings.TrimPrefix(auth.ServerAddress, "https://"),
+			"SYFT_REGISTRY_AUTH_USERNAME="+auth.Username,
+			"SYFT_REGISTRY_AUTH_PASSWORD="+auth.Password,
+		)
+	} else {
+		dc, err := dockerclient.NewClientWithOpts(
+			dockerclient.WithAPIVersionNegotiation(),
+			dockerclient.FromEnv,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to get docker client: %s", err)
+		}
+		img, _, err := dc.ImageInspectWithRaw(ctx, image)
+		if err != nil {
+			return fmt.Errorf("failed to inspect docker image '%s': %s", image, err)
+		}
+		labels = img.Config.Labels
+	}
+
+	log.Printf("generating SBOM of '%s'", image)
+
+	cmd := exec.CommandContext(ctx, "syft", "-q", "-o", o.Format+"-json", source)
+	cmd.Env = syftEnv
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to generate SBOM with syft: %s", err)
+	}
+	doc, err := addProxyToSBOM(out, o.Format, labels)
+	if err != nil {
+		return err
+	}
+
+	if o.Attach {
+		if err := attachSBOM(ctx, ecrCl, image, doc, sbomMediaTypes[o.Format]); err != nil {
+			return fmt.Errorf("failed to attach SBOM: %s", err)
+		}
+	}
+
+	_, err = os.Stdout.Write(doc)
+	return err
+}
+
+// addProxyToSBOM adds the lambdafy proxy, as identified by the labels of the
+// image, to the given SBOM. The proxy version is only known if it's the one
+// embedded in this lambdafy binary.
+func addProxyToSBOM(doc []byte, format string, labels map[string]string) ([]byte, error) {
+	chksum := labels[proxyChecksumLabel]
+	if chksum == "" {
+		log.Printf("warning: image is not lambdafied - lambdafy proxy is not added to SBOM")
+		return doc, nil
+	}
+	proxyVer := "unknown"
+	embedded := sha256.Sum256(proxyBinary)
+	if chksum == hex.EncodeToString(embedded[:]) {
+		proxyVer = version
+	}
+
+	var d map[string]interface{}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, fmt.Errorf("failed to decode SBOM: %s", err)
+	}
+	switch format {
+	case sbomFormatCycloneDX:
+		components, _ := d["components"].([]interface{})
+		d["components"] = append(components, map[string]interface{}{
+			"type":    "application",
+			"name":    "lambdafy-proxy",
+			"version": proxyVer,
+			"hashes":  []interface{}{map[string]string{"alg": "SHA-256", "content": chksum}},
+			"properties": []interface{}{
+				map[string]string{"name": "lambdafy:path", "value": "/lambdafy-proxy"},
+			},
+		})
+	case sbomFormatSPDX:
+		packages, _ := d["packages"].([]interface{})
+		d["packages"] = append(packages, map[string]interface{}{
+			"SPDXID":           "SPDXRef-Package-lambdafy-proxy",
+			"name":             "lambdafy-proxy",
+			"versionInfo":      proxyVer,
+			"downloadLocation": "NOASSERTION",
+			"checksums":        []interface{}{map[string]string{"algorithm": "SHA256", "checksumValue": chksum}},
+		})
+	}
+	b := bytes.Buffer{}
+	enc := json.NewEncoder(&b)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		return nil, fmt.Errorf("failed to encode SBOM: %s", err)
+	}
+	return b.Bytes(), nil
+}
+
+// ociEmptyConfig is the config blob of OCI artifacts which have no config.
+const ociEmptyConfig = "{}"
+
+// attachSBOM pushes the given SBOM to the repository of the given ECR image,
+// which must be pinned to a digest, as an OCI artifact referring to the image.
+func attachSBOM(ctx context.Context, ecrCl *ecr.Client, image string, doc []byte, mediaType string) error {
+	m := ecrImagePat.FindStringSubmatch(image)
+	registry, repoName, digest := m[1], m[3], m[5]
+
+	subj, err := ecrCl.BatchGetImage(ctx, &ecr.BatchGetImageInput{
+		RegistryId:     &registry,
+		RepositoryName: &repoName,
+		ImageIds:       []ecrtypes.ImageIdentifier{{ImageDigest: &digest}},
+		AcceptedMediaTypes: []string{
+			"application/vnd.docker.distribution.manifest.v2+json",
+			"application/vnd.oci.image.manifest.v1+json",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get image manifest: %s", err)
+	}
+	if len(subj.Images) == 0 || subj.Images[0].ImageManifest == nil {
+		return fmt.Errorf("image manifest not found")
+	}
+
+	configDigest, err := uploadBlob(ctx, ecrCl, registry, repoName, []byte(ociEmptyConfig))
+	if err != nil {
+		return err
+	}
+	docDigest, err := uploadBlob(ctx, ecrCl, registry, repoName, doc)
+	if err != nil {
+		return err
+	}
+
+	type descriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int    `json:"size"`
+	}
+	manifest, _ := json.Marshal(struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		ArtifactType  string       `json:"artifactType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+		Subject       descriptor   `json:"subject"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		ArtifactType:  mediaType,
+		Config:        descriptor{"application/vnd.oci.empty.v1+json", configDigest, len(ociEmptyConfig)},
+		Layers:        []descriptor{{mediaType, docDigest, len(doc)}},
+		Subject:       descriptor{*subj.Images[0].ImageManifestMediaType, digest, len(*subj.Images[0].ImageManifest)},
+	})
+	out, err := ecrCl.PutImage(ctx, &ecr.PutImageInput{
+		RegistryId:             &registry,
+		RepositoryName:         &repoName,
+		ImageManifest:          aws.String(string(manifest)),
+		ImageManifestMediaType: aws.String("application/vnd.oci.image.manifest.v1+json"),
+	})
+	if err != nil {
+		if apiErrorCode(err) == "ImageAlreadyExistsException" {
+			log.Printf("identical SBOM is already attached to the image")
+			return nil
+		}
+		return fmt.Errorf("failed to put SBOM manifest: %s", err)
+	}
+	log.Printf("attached SBOM as %s", *out.Image.ImageId.ImageDigest)
+	return nil
+}
+
+// maxLayerPartSize is the size of the parts blobs are uploaded to ECR in.
+const maxLayerPartSize = 10 * 1024 * 1024
+
+// uploadBlob uploads the given blob to the ECR repository unless it already
+// exists and returns its digest.
+func uploadBlob(ctx context.Context, ecrCl *ecr.Client, registry string, repoName string, blob []byte) (string, error) {
+	sum := sha256.Sum256(blob)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	avail, err := ecrCl.BatchCheckLayerAvailability(ctx, &ecr.BatchCheckLayerAvailabilityInput{
+		RegistryId:     &registry,
+		RepositoryName: &repoName,
+		LayerDigests:   []string{digest},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to check blob availability: %s", err)
+	}
+	if len(avail.Layers) > 0 && avail.Layers[0].LayerAvailability == ecrtypes.LayerAvailabilityAvailable {
+		return digest, nil
+	}
+
+	up, err := ecrCl.InitiateLayerUpload(ctx, &ecr.InitiateLayerUploadInput{
+		RegistryId:     &registry,
+		RepositoryName: &repoName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to initiate blob upload: %s", err)
+	}
+	for start := 0; start < len(blob); start += maxLayerPartSize {
+		end := start + maxLayerPartSize
+		if end > len(blob) {
+			end = len(blob)
+		}
+		if _, err := ecrCl.UploadLayerPart(ctx, &ecr.UploadLayerPartInput{
+			RegistryId:     &registry,
+			RepositoryName: &repoName,
+			UploadId:       up.UploadId,
+			PartFirstByte:  aws.Int64(int64(start)),
+			PartLastByte:   aws.Int64(int64(end - 1)),
+			LayerPartBlob:  blob[start:end],
+		}); err != nil {
+			return "", fmt.Errorf("failed to upload blob: %s", err)
+		}
+	}
+	if _, err := ecrCl.CompleteLayerUpload(ctx, &ecr.CompleteLayerUploadInput{
+		RegistryId:     &registry,
+		RepositoryName: &repoName,
+		UploadId:       up.UploadId,
+		LayerDigests:   []string{digest},
+	}); err != nil && apiErrorCode(err) != "LayerAlreadyExistsException" {
+		return "", fmt.Errorf("failed to complete blob upload: %s", err)
+	}
+	return digest, nil
+}
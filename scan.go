@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/spf13/cobra"
+)
+
+// scanGateOptions controls whether images must pass their vulnerability scan
+// before being published or deployed.
+type scanGateOptions struct {
+	// Require enables the gate.
+	Require bool
+	// MaxCritical is the number of critical findings allowed.
+	MaxCritical int
+	// Bypass lets images that fail the gate through. The bypass is logged along
+	// with the identity of the caller.
+	Bypass bool
+}
+
+// addScanGateFlags adds the flags of the scan gate to the given command.
+func addScanGateFlags(c *cobra.Command, o *scanGateOptions) {
+	c.Flags().BoolVar(&o.Require, "require-scan-pass", false, "Abort unless the ECR scan of the image has at most --max-critical critical findings")
+	c.Flags().IntVar(&o.MaxCritical, "max-critical", 0, "Number of critical findings allowed by --require-scan-pass")
+	c.Flags().BoolVar(&o.Bypass, "bypass-scan-gate", false, "Continue even if the image fails --require-scan-pass - the bypass is recorded along with your identity")
+}
+
+// checkScanGate ensures the scan findings of the given ECR image are within the
+// limits of the gate. If the image fails the gate and bypassing is allowed, the
+// ARN of the caller who bypassed it is returned.
+func checkScanGate(ctx context.Context, clients *awsClients, image string, o scanGateOptions) (bypassedBy string, err error) {
+	if !o.Require {
+		return "", nil
+	}
+	if o.MaxCritical < 0 {
+		return "", fmt.Errorf("--max-critical must not be negative")
+	}
+
+	log.Printf("checking scan findings of image '%s'", image)
+
+	gateErr := checkScanFindings(ctx, clients.ecr(), image, o.MaxCritical)
+	if gateErr == nil {
+		return "", nil
+	}
+	if !o.Bypass {
+		return "", fmt.Errorf("image failed the scan gate: %s - pass --bypass-scan-gate to continue anyway", gateErr)
+	}
+
+	ident, err := clients.sts().GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller identity to record scan gate bypass: %s", err)
+	}
+	log.Printf("warning: scan gate bypassed by '%s': %s", *ident.Arn, gateErr)
+	return *ident.Arn, nil
+}
+
+// checkScanFindings waits for the scan of the given ECR image to complete and
+// ensures it has at most maxCritical critical findings. Both basic and enhanced
+// (Amazon Inspector) scanning are supported.
+func checkScanFindings(ctx context.Context, ecrCl *ecr.Client, image string, maxCritical int) error {
+	m := ecrImagePat.FindStringSubmatch(image)
+	if m == nil {
+		return fmt.Errorf("'%s' is not a valid ECR image URI", image)
+	}
+	registry, repoName, tag, digest := m[1], m[3], m[4], m[5]
+
+	// Findings are looked up by digest so that a tag moved in the meantime does
+	// not get the wrong image through.
+
+	if digest == "" {
+		var err error
+		if digest, err = resolveImageDigest(ctx, ecrCl, registry, repoName, tag); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		out, err := ecrCl.DescribeImageScanFindings(ctx, &ecr.DescribeImageScanFindingsInput{
+			RegistryId:     &registry,
+			RepositoryName: &repoName,
+			ImageId:        &ecrtypes.ImageIdentifier{ImageDigest: &digest},
+		})
+		if err != nil {
+			if apiErrorCode(err) == "ScanNotFoundException" {
+				return fmt.Errorf("image '%s' has not been scanned", digest)
+			}
+			return fmt.Errorf("failed to describe scan findings: %s", err)
+		}
+
+		var status ecrtypes.ScanStatus
+		if out.ImageScanStatus != nil {
+			status = out.ImageScanStatus.Status
+		}
+		switch status {
+		case ecrtypes.ScanStatusComplete, ecrtypes.ScanStatusActive:
+		case ecrtypes.ScanStatusInProgress, ecrtypes.ScanStatusPending:
+			verbosef("scan of image '%s' is %s", digest, status)
+			if err := sleepCtx(ctx, retryDelay(attempt)); err != nil {
+				return fmt.Errorf("timed out waiting for scan to complete: %s", err)
+			}
+			continue
+		default:
+			reason := ""
+			if out.ImageScanStatus != nil && out.ImageScanStatus.Description != nil {
+				reason = ": " + *out.ImageScanStatus.Description
+			}
+			return fmt.Errorf("scan of image '%s' is %s%s", digest, status, reason)
+		}
+
+		var critical int32
+		if out.ImageScanFindings != nil {
+			critical = out.ImageScanFindings.FindingSeverityCounts[string(ecrtypes.FindingSeverityCritical)]
+		}
+		if int(critical) > maxCritical {
+			return fmt.Errorf("image '%s' has %d critical findings which is more than the allowed %d", digest, critical, maxCritical)
+		}
+		return nil
+	}
+}
+
+// scanGateBypassTag is the function tag recording the last scan gate bypass.
+// A single tag is kept, rather than one per bypass, so that bypasses can't use
+// up the tags a function can have. Publish leaves it alone.
+const scanGateBypassTag = "lambdafy:scan-gate-bypass"
+
+// scanGateBypassDesc is in the description of the active alias while the
+// version it points to was deployed bypassing the scan gate.
+const scanGateBypassDesc = "deployed bypassing scan gate"
+
+// tagScanGateBypass records in a function tag that the given version is being
+// deployed bypassing the scan gate by the given caller.
+func tagScanGateBypass(ctx context.Context, lambdaCl *lambda.Client, fnName string, version int, by string) error {
+	rec := fmt.Sprintf("version %d by %s at %s", version, by, time.Now().UTC().Format(time.RFC3339))
+	if len(rec) > 256 {
+		rec = rec[:256]
+	}
+	fn, err := lambdaCl.GetFunction(ctx, &lambda.GetFunctionInput{FunctionName: &fnName})
+	if err != nil {
+		return fmt.Errorf("failed to get function: %s", err)
+	}
+	if _, err := lambdaCl.TagResource(ctx, &lambda.TagResourceInput{
+		Resource: fn.Configuration.FunctionArn,
+		Tags:     map[string]string{scanGateBypassTag: rec},
+	}); err != nil {
+		return fmt.Errorf("failed to tag function with scan gate bypass: %s", err)
+	}
+	return nil
+}
+
+// updateScanGateAliasDesc sets the description of the active alias to record
+// that the given version was deployed bypassing the scan gate by the given
+// caller. If by is empty, a description left by an earlier bypass is cleared.
+func updateScanGateAliasDesc(ctx context.Context, lambdaCl *lambda.Client, fnName string, version int, by string) error {
+	desc := ""
+	if by != "" {
+		desc = fmt.Sprintf("version %d %s by %s at %s", version, scanGateBypassDesc, by, time.Now().UTC().Format(time.RFC3339))
+		if len(desc) > 256 {
+			desc = desc[:256]
+		}
+	} else {
+		a, err := lambdaCl.GetAlias(ctx, &lambda.GetAliasInput{
+			FunctionName: &fnName,
+			Name:         aws.String(activeAlias),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get alias '%s': %s", activeAlias, err)
+		}
+		if !strings.Contains(aws.ToString(a.Description), scanGateBypassDesc) {
+			return nil
+		}
+	}
+
+	if err := retryOnResourceConflict(ctx, func() error {
+		_, err := lambdaCl.UpdateAlias(ctx, &lambda.UpdateAliasInput{
+			FunctionName: &fnName,
+			Name:         aws.String(activeAlias),
+			Description:  &desc,
+		})
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to update description of alias '%s': %s", activeAlias, err)
+	}
+	return nil
+}
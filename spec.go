@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -11,9 +10,10 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/scheduler"
+	schedulertypes "github.com/aws/aws-sdk-go-v2/service/scheduler/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/mathspace/lambdafy/fnspec"
 	"github.com/spf13/cobra"
@@ -23,39 +23,52 @@ var specCmd *cobra.Command
 
 func init() {
 	var ver string
+	var format string
+	var comments bool
 	specCmd = &cobra.Command{
 		Use:   "spec function-name",
 		Short: "Generate a function spec from published function",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(c *cobra.Command, args []string) error {
 			fnName := args[0]
-			version, err := resolveVersion(fnName, ver)
+			version, err := resolveVersion(c.Context(), fnName, ver)
 			if err != nil {
 				return fmt.Errorf("failed to resolve version: %s", err)
 			}
 
-			s, err := generateSpec(fnName, version)
+			s, err := generateSpec(c.Context(), fnName, version)
 			if err != nil {
 				return fmt.Errorf("failed to generate spec: %s", err)
 			}
-			fmt.Fprintf(os.Stdout, "# Generated by 'lambdafy spec --version %d %s'\n\n", version, fnName)
-			return s.Save(os.Stdout)
+			opts := fnspec.SaveOptions{Format: format}
+			if comments {
+				opts.Comments, err = fnspec.ParseComments(strings.NewReader(exampleSpec))
+				if err != nil {
+					return fmt.Errorf("failed to parse example spec comments: %s", err)
+				}
+			}
+			if format != fnspec.FormatJSON {
+				fmt.Fprintf(os.Stdout, "# Generated by 'lambdafy spec --version %d %s'\n\n", version, fnName)
+			}
+			return s.SaveWithOptions(os.Stdout, opts)
 		},
 	}
 	addVersionFlag(specCmd.Flags(), &ver)
+	specCmd.Flags().StringVar(&format, "format", fnspec.FormatYAML, "output format: yaml or json (both can be published)")
+	specCmd.Flags().BoolVar(&comments, "comments", false, "document each field with comments from the example spec (yaml only)")
 }
 
 // generateSpec generates a function spec from a published function.
-func generateSpec(fnName string, fnVersion int) (fnspec.Spec, error) {
+func generateSpec(ctx context.Context, fnName string, fnVersion int) (fnspec.Spec, error) {
 
 	spec := fnspec.Spec{}
 
-	ctx := context.Background()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return spec, fmt.Errorf("failed to load aws config: %s", err)
 	}
-	lambdaCl := lambda.NewFromConfig(acfg)
+	acfg := clients.config()
+	lambdaCl := clients.lambda()
 
 	gfo, err := lambdaCl.GetFunction(ctx, &lambda.GetFunctionInput{
 		FunctionName: &fnName,
@@ -75,44 +88,71 @@ func generateSpec(fnName string, fnVersion int) (fnspec.Spec, error) {
 	spec.Role = *gfo.Configuration.Role
 
 	if env := gfo.Configuration.Environment; env != nil {
-		spec.Env = env.Variables
 
 		// Parse Cors
 
-		if cors, ok := spec.Env[specInEnvPrefix+"CORS"]; ok {
-			var c struct {
-				Origins []string `json:"origins"`
-				Methods []string `json:"methods"`
-				Headers []string `json:"headers"`
-			}
+		if cors, ok := env.Variables[specInEnvPrefix+"CORS"]; ok {
+			var c fnspec.CORS
 			if err := json.Unmarshal([]byte(cors), &c); err != nil {
 				return spec, fmt.Errorf("failed to parse CORS configuration: %s", err)
 			}
-			spec.CORS.Origins = c.Origins
-			spec.CORS.Methods = c.Methods
-			spec.CORS.Headers = c.Headers
+			spec.CORS = c
+		}
+
+		// Parse URL auth
+
+		if a, ok := env.Variables[specInEnvPrefix+"URL_AUTH"]; ok {
+			spec.URLAuth = a
 		}
 
 		// Parse cron spec
 
-		spec.CronTriggers = make(map[string]string)
-		for k, v := range spec.Env {
+		spec.CronTriggers = make(map[string]*fnspec.CronTrigger)
+		for k, v := range env.Variables {
 			if strings.HasPrefix(k, specInEnvCronPrefix) {
-				spec.CronTriggers[k[len(specInEnvCronPrefix):]] = v
+				c, err := decodeCronEnv(v)
+				if err != nil {
+					return spec, fmt.Errorf("failed to parse cron trigger '%s': %s", k, err)
+				}
+				spec.CronTriggers[k[len(specInEnvCronPrefix):]] = c
 			}
 		}
-		if len(spec.CronTriggers) == 0 {
-			spec.CronTriggers = nil
-		}
 
-		// HACK remove specInEnvPrefix prefixed env vars as they are a hack to store
+		// HACK exclude specInEnvPrefix prefixed env vars as they are a hack to store
 		// spec related stuff in the function config.
 
-		for k := range spec.Env {
-			if strings.HasPrefix(k, specInEnvPrefix) {
-				delete(spec.Env, k)
+		spec.Env = make(map[string]string)
+		for k, v := range env.Variables {
+			if !strings.HasPrefix(k, specInEnvPrefix) {
+				spec.Env[k] = v
 			}
 		}
+		if len(spec.Env) == 0 {
+			spec.Env = nil
+		}
+	}
+
+	// Functions published by older versions of lambdafy may not have the CORS
+	// and cron settings in their env vars. Reconstruct them from the URL config
+	// and schedules of the version instead.
+
+	if len(spec.CORS.Origins) == 0 {
+		cors, err := versionCORS(ctx, lambdaCl, fnName, fnVersion)
+		if err != nil {
+			return spec, err
+		}
+		spec.CORS = cors
+	}
+
+	if len(spec.CronTriggers) == 0 {
+		crons, err := versionCronTriggers(ctx, clients.scheduler(), fnName, *gfo.Configuration.FunctionArn)
+		if err != nil {
+			return spec, err
+		}
+		spec.CronTriggers = crons
+	}
+	if len(spec.CronTriggers) == 0 {
+		spec.CronTriggers = nil
 	}
 
 	if icr := gfo.Configuration.ImageConfigResponse; icr != nil {
@@ -124,7 +164,15 @@ func generateSpec(fnName string, fnVersion int) (fnspec.Spec, error) {
 	}
 	spec.Memory = gfo.Configuration.MemorySize
 	spec.Timeout = gfo.Configuration.Timeout
-	spec.Tags = gfo.Tags
+	for k, v := range gfo.Tags {
+		if k == scanGateBypassTag {
+			continue
+		}
+		if spec.Tags == nil {
+			spec.Tags = map[string]string{}
+		}
+		spec.Tags[k] = v
+	}
 	if gfo.Configuration.VpcConfig != nil {
 		spec.VPCSecurityGroupIds = gfo.Configuration.VpcConfig.SecurityGroupIds
 		sort.StringSlice(spec.VPCSecurityGroupIds).Sort()
@@ -137,7 +185,10 @@ func generateSpec(fnName string, fnVersion int) (fnspec.Spec, error) {
 			Path: *fsc.LocalMountPath,
 		})
 	}
-	spec.TempSize = gfo.Configuration.EphemeralStorage.Size
+	// 512 is the default and is omitted to keep the spec minimal.
+	if es := gfo.Configuration.EphemeralStorage; es != nil && es.Size != nil && *es.Size != 512 {
+		spec.TempSize = es.Size
+	}
 
 	// Get SQS triggers
 
@@ -164,13 +215,34 @@ func generateSpec(fnName string, fnVersion int) (fnspec.Spec, error) {
 			if es.BatchSize == nil {
 				es.BatchSize = aws.Int32(10)
 			}
+			if es.BatchWindow != nil && *es.BatchWindow == 0 {
+				es.BatchWindow = nil
+			}
 			spec.SQSTriggers = append(spec.SQSTriggers, &es)
 		}
 	}
+	sort.Slice(spec.SQSTriggers, func(i, j int) bool {
+		return spec.SQSTriggers[i].ARN < spec.SQSTriggers[j].ARN
+	})
+
+	// Get invoke permissions
+
+	invPerms, err := functionInvokePermissions(ctx, lambdaCl, fnName)
+	if err != nil {
+		return spec, err
+	}
+	for _, ps := range invPerms {
+		for _, p := range ps {
+			spec.InvokePermissions = append(spec.InvokePermissions, p)
+		}
+	}
+	sort.Slice(spec.InvokePermissions, func(i, j int) bool {
+		return invokeStatementID(spec.InvokePermissions[i]) < invokeStatementID(spec.InvokePermissions[j])
+	})
 
 	// Derive allowed account regions from current account and region.
 
-	stsCl := sts.NewFromConfig(acfg)
+	stsCl := clients.sts()
 	ident, err := stsCl.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
 	if err != nil {
 		return spec, fmt.Errorf("failed to get caller identity: %s", err)
@@ -181,11 +253,13 @@ func generateSpec(fnName string, fnVersion int) (fnspec.Spec, error) {
 
 	if err := func() error {
 		roleName := spec.Role[strings.LastIndex(spec.Role, "/")+1:]
-		if !strings.HasPrefix(roleName, generatedRolePrefix) {
+		i := strings.Index(roleName, generatedRolePrefix)
+		if i < 0 {
 			return nil
 		}
-		chksum := roleName[len(generatedRolePrefix):]
-		iamCl := iam.NewFromConfig(acfg)
+		namePrefix := roleName[:i]
+		chksum := roleName[i+len(generatedRolePrefix):]
+		iamCl := clients.iam()
 		r, err := iamCl.GetRole(ctx, &iam.GetRoleInput{
 			RoleName: &roleName,
 		})
@@ -218,7 +292,18 @@ func generateSpec(fnName string, fnVersion int) (fnspec.Spec, error) {
 		if err != nil {
 			return fmt.Errorf("failed to canonicalize role policy: %s", err)
 		}
-		if fmt.Sprintf("%x", md5.Sum([]byte(polDoc))) != chksum {
+		var rolePath string
+		if r.Role.Path != nil && *r.Role.Path != "/" {
+			rolePath = *r.Role.Path
+		}
+		var roleTags map[string]string
+		for _, t := range r.Role.Tags {
+			if roleTags == nil {
+				roleTags = map[string]string{}
+			}
+			roleTags[*t.Key] = *t.Value
+		}
+		if generatedRoleHash(polDoc, rolePath, roleTags) != chksum {
 			return nil
 		}
 
@@ -230,7 +315,30 @@ func generateSpec(fnName string, fnVersion int) (fnspec.Spec, error) {
 		}
 
 		spec.Role = fnspec.RoleGenerate
-		spec.RoleExtraPolicy = policies.Statement[1:] // The first one is the default one we add.
+		spec.RoleNamePrefix = namePrefix
+		spec.RolePath = rolePath
+		spec.RoleTags = roleTags
+
+		// Scoped policies mark the statements we add with a Sid prefix whereas
+		// the permissive one has a single unmarked statement at the start.
+
+		scoped := false
+		for _, st := range policies.Statement {
+			if strings.HasPrefix(st.Sid, fnspec.GeneratedSidPrefix) {
+				scoped = true
+				break
+			}
+		}
+		if !scoped {
+			spec.RolePolicyMode = fnspec.RolePolicyPermissive
+			spec.RoleExtraPolicy = policies.Statement[1:]
+			return nil
+		}
+		for _, st := range policies.Statement {
+			if !strings.HasPrefix(st.Sid, fnspec.GeneratedSidPrefix) {
+				spec.RoleExtraPolicy = append(spec.RoleExtraPolicy, st)
+			}
+		}
 		return nil
 	}(); err != nil {
 		return spec, err
@@ -238,3 +346,93 @@ func generateSpec(fnName string, fnVersion int) (fnspec.Spec, error) {
 
 	return spec, nil
 }
+
+// versionCORS returns the CORS config of the URL of the active (or otherwise
+// any) alias pointing to the given function version.
+func versionCORS(ctx context.Context, lambdaCl *lambda.Client, fnName string, fnVersion int) (fnspec.CORS, error) {
+	var cors fnspec.CORS
+	var aliases []string
+	ap := lambda.NewListAliasesPaginator(lambdaCl, &lambda.ListAliasesInput{
+		FunctionName:    &fnName,
+		FunctionVersion: aws.String(strconv.Itoa(fnVersion)),
+	})
+	for ap.HasMorePages() {
+		page, err := ap.NextPage(ctx)
+		if err != nil {
+			return cors, fmt.Errorf("failed to list aliases: %s", err)
+		}
+		for _, a := range page.Aliases {
+			aliases = append(aliases, *a.Name)
+		}
+	}
+	sort.SliceStable(aliases, func(i, j int) bool {
+		return aliases[i] == activeAlias && aliases[j] != activeAlias
+	})
+
+	for _, a := range aliases {
+		u, err := lambdaCl.GetFunctionUrlConfig(ctx, &lambda.GetFunctionUrlConfigInput{
+			FunctionName: &fnName,
+			Qualifier:    aws.String(a),
+		})
+		if err != nil {
+			if apiErrorCode(err) == "ResourceNotFoundException" {
+				continue
+			}
+			return cors, fmt.Errorf("failed to get function URL config: %s", err)
+		}
+		if u.Cors != nil {
+			cors.Origins = u.Cors.AllowOrigins
+			cors.Methods = u.Cors.AllowMethods
+			cors.Headers = u.Cors.AllowHeaders
+		}
+		break
+	}
+	return cors, nil
+}
+
+// versionCronTriggers returns the cron triggers of the function whose
+// schedules target the given function ARN.
+func versionCronTriggers(ctx context.Context, schedCl *scheduler.Client, fnName string, fnARN string) (map[string]*fnspec.CronTrigger, error) {
+	crons := map[string]*fnspec.CronTrigger{}
+	groupName := scheduleGroupName(fnName)
+	namePrefix := scheduleName(fnName, "")
+	sp := scheduler.NewListSchedulesPaginator(schedCl, &scheduler.ListSchedulesInput{
+		GroupName: &groupName,
+	})
+	for sp.HasMorePages() {
+		page, err := sp.NextPage(ctx)
+		if err != nil {
+			if apiErrorCode(err) == "ResourceNotFoundException" {
+				return crons, nil
+			}
+			return nil, fmt.Errorf("failed to list schedules: %s", err)
+		}
+		for _, sc := range page.Schedules {
+			if sc.Target == nil || *sc.Target.Arn != fnARN || !strings.HasPrefix(*sc.Name, namePrefix) {
+				continue
+			}
+			gso, err := schedCl.GetSchedule(ctx, &scheduler.GetScheduleInput{
+				GroupName: &groupName,
+				Name:      sc.Name,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get schedule '%s': %s", *sc.Name, err)
+			}
+			expr := *gso.ScheduleExpression
+			if !strings.HasPrefix(expr, "cron(") || !strings.HasSuffix(expr, ")") {
+				continue
+			}
+			c := &fnspec.CronTrigger{
+				Schedule: expr[len("cron(") : len(expr)-1],
+			}
+			if gso.Description != nil {
+				c.Description = *gso.Description
+			}
+			if gso.State == schedulertypes.ScheduleStateDisabled {
+				c.Enabled = aws.Bool(false)
+			}
+			crons[(*sc.Name)[len(namePrefix):]] = c
+		}
+	}
+	return crons, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/spf13/cobra"
+
+	"github.com/mathspace/lambdafy/fnspec"
+)
+
+var urlCmd = &cobra.Command{
+	Use:   "url",
+	Short: "Manage the function URL of an alias",
+	Long: "Manage the function URL of an alias. The auth type and CORS settings " +
+		"are reset from the spec on the next deploy.",
+}
+
+func init() {
+	var al, auth, invokeMode string
+
+	showCmd := &cobra.Command{
+		Use:   "show function-name",
+		Short: "Print out the function URL config of an alias",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			u, err := getURL(c.Context(), args[0], al)
+			if err != nil {
+				return err
+			}
+			return formatOutput(u)
+		},
+	}
+	showCmd.Flags().StringVarP(&al, "alias", "a", activeAlias, "alias of the function URL")
+	urlCmd.AddCommand(showCmd)
+
+	createCmd := &cobra.Command{
+		Use:   "create function-name",
+		Short: "Create the function URL of an alias",
+		Long: "Create the function URL of an alias. Unless given, the auth type " +
+			"and CORS settings are taken from the spec of the version the alias " +
+			"points to.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			u, err := createURL(c.Context(), args[0], al, auth, invokeMode)
+			if err != nil {
+				return err
+			}
+			return formatOutput(u)
+		},
+	}
+	createCmd.Flags().StringVarP(&al, "alias", "a", activeAlias, "alias of the function URL")
+	createCmd.Flags().StringVar(&auth, "auth", "", fmt.Sprintf("auth type of the function URL - one of %s or %s (default: from spec)", fnspec.URLAuthNone, fnspec.URLAuthIAM))
+	createCmd.Flags().StringVar(&invokeMode, "invoke-mode", "", "invoke mode of the function URL - one of BUFFERED or RESPONSE_STREAM (default: BUFFERED)")
+	urlCmd.AddCommand(createCmd)
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete function-name",
+		Short: "Delete the function URL of an alias",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			clients, err := awsClientsFrom(c.Context())
+			if err != nil {
+				return fmt.Errorf("failed to load aws config: %s", err)
+			}
+			return deleteAliasURL(c.Context(), clients.lambda(), args[0], al)
+		},
+	}
+	deleteCmd.Flags().StringVarP(&al, "alias", "a", activeAlias, "alias of the function URL")
+	urlCmd.AddCommand(deleteCmd)
+
+	authCmd := &cobra.Command{
+		Use:   "auth function-name auth-type",
+		Short: fmt.Sprintf("Change the auth type of the function URL of an alias to %s or %s", fnspec.URLAuthNone, fnspec.URLAuthIAM),
+		Args:  cobra.ExactArgs(2),
+		RunE: func(c *cobra.Command, args []string) error {
+			u, err := setURLAuth(c.Context(), args[0], al, args[1])
+			if err != nil {
+				return err
+			}
+			return formatOutput(u)
+		},
+	}
+	authCmd.Flags().StringVarP(&al, "alias", "a", activeAlias, "alias of the function URL")
+	urlCmd.AddCommand(authCmd)
+}
+
+// fnURL represents the function URL config of an alias.
+type fnURL struct {
+	Alias      string       `json:"alias"`
+	URL        string       `json:"url"`
+	Auth       string       `json:"auth"`
+	InvokeMode string       `json:"invoke_mode"`
+	CORS       *fnspec.CORS `json:"cors"`
+}
+
+// newFnURL converts the given function URL config fields.
+func newFnURL(alias string, url *string, authType lambdatypes.FunctionUrlAuthType, invokeMode lambdatypes.InvokeMode, cors *lambdatypes.Cors) fnURL {
+	u := fnURL{
+		Alias:      alias,
+		URL:        aws.ToString(url),
+		Auth:       fnspec.URLAuthNone,
+		InvokeMode: string(invokeMode),
+	}
+	if authType == lambdatypes.FunctionUrlAuthTypeAwsIam {
+		u.Auth = fnspec.URLAuthIAM
+	}
+	if u.InvokeMode == "" {
+		u.InvokeMode = string(lambdatypes.InvokeModeBuffered)
+	}
+	if cors != nil && (len(cors.AllowOrigins) > 0 || len(cors.AllowMethods) > 0 || len(cors.AllowHeaders) > 0) {
+		u.CORS = &fnspec.CORS{
+			Origins: cors.AllowOrigins,
+			Methods: cors.AllowMethods,
+			Headers: cors.AllowHeaders,
+		}
+	}
+	return u
+}
+
+// parseURLAuth converts the given auth type as used in specs.
+func parseURLAuth(auth string) (lambdatypes.FunctionUrlAuthType, error) {
+	switch auth {
+	case fnspec.URLAuthNone:
+		return lambdatypes.FunctionUrlAuthTypeNone, nil
+	case fnspec.URLAuthIAM:
+		return lambdatypes.FunctionUrlAuthTypeAwsIam, nil
+	}
+	return "", fmt.Errorf("invalid auth type '%s' - must be %s or %s", auth, fnspec.URLAuthNone, fnspec.URLAuthIAM)
+}
+
+// getURL returns the function URL config of the given alias.
+func getURL(ctx context.Context, fnName string, alias string) (fnURL, error) {
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return fnURL{}, fmt.Errorf("failed to load aws config: %s", err)
+	}
+
+	u, err := clients.lambda().GetFunctionUrlConfig(ctx, &lambda.GetFunctionUrlConfigInput{
+		FunctionName: &fnName,
+		Qualifier:    &alias,
+	})
+	if err != nil {
+		if apiErrorCode(err) == "ResourceNotFoundException" {
+			return fnURL{}, fmt.Errorf("alias '%s' of function '%s' has no function URL", alias, fnName)
+		}
+		return fnURL{}, fmt.Errorf("failed to get function URL: %s", err)
+	}
+	return newFnURL(alias, u.FunctionUrl, u.AuthType, u.InvokeMode, u.Cors), nil
+}
+
+// createURL creates the function URL of the given alias. Empty auth and
+// invokeMode default to the auth type in the spec and buffered respectively.
+func createURL(ctx context.Context, fnName string, alias string, auth string, invokeMode string) (fnURL, error) {
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return fnURL{}, fmt.Errorf("failed to load aws config: %s", err)
+	}
+	lambdaCl := clients.lambda()
+
+	gfo, err := lambdaCl.GetFunction(ctx, &lambda.GetFunctionInput{
+		FunctionName: &fnName,
+		Qualifier:    &alias,
+	})
+	if err != nil {
+		return fnURL{}, fmt.Errorf("failed to get function '%s' alias '%s': %s", fnName, alias, err)
+	}
+	authType, cors, err := specURLConfig(gfo.Configuration.Environment)
+	if err != nil {
+		return fnURL{}, err
+	}
+	if auth != "" {
+		if authType, err = parseURLAuth(auth); err != nil {
+			return fnURL{}, err
+		}
+	}
+
+	in := &lambda.CreateFunctionUrlConfigInput{
+		AuthType:     authType,
+		FunctionName: &fnName,
+		Qualifier:    &alias,
+		Cors:         &cors,
+	}
+	if invokeMode != "" {
+		switch mode := lambdatypes.InvokeMode(invokeMode); mode {
+		case lambdatypes.InvokeModeBuffered, lambdatypes.InvokeModeResponseStream:
+			in.InvokeMode = mode
+		default:
+			return fnURL{}, fmt.Errorf("invalid invoke mode '%s' - must be %s or %s", invokeMode, lambdatypes.InvokeModeBuffered, lambdatypes.InvokeModeResponseStream)
+		}
+	}
+
+	var cfuc *lambda.CreateFunctionUrlConfigOutput
+	if err := retryOnResourceConflict(ctx, func() error {
+		cfuc, err = lambdaCl.CreateFunctionUrlConfig(ctx, in)
+		return err
+	}); err != nil {
+		if strings.Contains(err.Error(), "exists for this") {
+			return fnURL{}, fmt.Errorf("alias '%s' already has a function URL", alias)
+		}
+		return fnURL{}, fmt.Errorf("failed to create function URL for alias '%s': %s", alias, err)
+	}
+
+	if err := setURLPublicAccess(ctx, lambdaCl, fnName, alias, authType); err != nil {
+		return fnURL{}, err
+	}
+	return newFnURL(alias, cfuc.FunctionUrl, cfuc.AuthType, cfuc.InvokeMode, cfuc.Cors), nil
+}
+
+// setURLAuth changes the auth type of the function URL of the given alias and
+// adds or removes its public access permission accordingly.
+func setURLAuth(ctx context.Context, fnName string, alias string, auth string) (fnURL, error) {
+	authType, err := parseURLAuth(auth)
+	if err != nil {
+		return fnURL{}, err
+	}
+	clients, err := awsClientsFrom(ctx)
+	if err != nil {
+		return fnURL{}, fmt.Errorf("failed to load aws config: %s", err)
+	}
+	lambdaCl := clients.lambda()
+
+	var ufuc *lambda.UpdateFunctionUrlConfigOutput
+	if err := retryOnResourceConflict(ctx, func() error {
+		ufuc, err = lambdaCl.UpdateFunctionUrlConfig(ctx, &lambda.UpdateFunctionUrlConfigInput{
+			AuthType:     authType,
+			FunctionName: &fnName,
+			Qualifier:    &alias,
+		})
+		return err
+	}); err != nil {
+		if apiErrorCode(err) == "ResourceNotFoundException" {
+			return fnURL{}, fmt.Errorf("alias '%s' of function '%s' has no function URL", alias, fnName)
+		}
+		return fnURL{}, fmt.Errorf("failed to update function URL for alias '%s': %s", alias, err)
+	}
+
+	if err := setURLPublicAccess(ctx, lambdaCl, fnName, alias, authType); err != nil {
+		return fnURL{}, err
+	}
+	log.Printf("changed auth type of '%s' alias URL to %s", alias, auth)
+	return newFnURL(alias, ufuc.FunctionUrl, ufuc.AuthType, ufuc.InvokeMode, ufuc.Cors), nil
+}
@@ -6,14 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/url"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/aws/smithy-go"
 	dockerjsonmsg "github.com/docker/docker/pkg/jsonmessage"
 )
 
@@ -39,30 +42,139 @@ func canonicalizePolicyString(s string, urlenc bool) (string, error) {
 	return strings.TrimSpace(string(b)), nil
 }
 
-// retryOnResourceConflict retries a function if it returns a resource conflict error.
-// It also retries on a few other errors that are known to be transient.
-// Deprecated: use retry() instead.
+const (
+	// retryMaxAttempts is the maximum number of times a function is attempted
+	// by retryOnResourceConflict before giving up.
+	retryMaxAttempts = 20
+	// retryBaseDelay is the delay before the first retry. Every subsequent
+	// retry doubles it, up to retryMaxDelay.
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// apiErrorCode returns the AWS API error code of the given error (e.g.
+// ResourceConflictException) or empty string if it is not an API error.
+func apiErrorCode(err error) string {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return ae.ErrorCode()
+	}
+	return ""
+}
+
+// apiErrorMessage returns the AWS API error message of the given error or
+// the full error string if it is not an API error.
+func apiErrorMessage(err error) string {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return ae.ErrorMessage()
+	}
+	return err.Error()
+}
+
+// isRetryableError returns true if the error is known to be transient.
+func isRetryableError(err error) bool {
+	switch apiErrorCode(err) {
+	case "TooManyRequestsException", "ThrottlingException", "ResourceInUseException":
+		return true
+	case "ResourceConflictException", "ConflictException":
+		// Conflicts due to updates in progress go away but the ones due to already
+		// existing resources don't.
+		return !strings.Contains(apiErrorMessage(err), "exists")
+	case "InvalidParameterValueException":
+		// Newly created IAM roles take a while to propagate to lambda and
+		// scheduler.
+		msg := apiErrorMessage(err)
+		return strings.Contains(msg, "role defined for the function cannot be assumed") ||
+			strings.Contains(msg, "ARN does not refer to a valid principal")
+	}
+	return false
+}
+
+// retryDelay returns the delay before the given retry attempt (starting from
+// 1), using exponential backoff with full jitter. Attempts below 1 are treated
+// as 1.
+func retryDelay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := retryMaxDelay
+	if attempt < 16 {
+		if e := retryBaseDelay << (attempt - 1); e < retryMaxDelay {
+			d = e
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// maxParallelCalls bounds the number of AWS calls made at once by parallel.
+const maxParallelCalls = 8
+
+// parallel calls fn for each index in [0, n) with at most maxParallelCalls
+// calls running at a time. The context passed to fn is cancelled as soon as a
+// call fails and the first error is returned.
+func parallel(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sem := make(chan struct{}, maxParallelCalls)
+	errCh := make(chan error, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(ctx, i); err != nil {
+				errCh <- err
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// sleepCtx sleeps for the given duration or until the context is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryOnResourceConflict retries a function if it returns a resource conflict
+// error. It also retries on a few other errors that are known to be transient
+// such as throttling and IAM role propagation delays. Retries back off
+// exponentially and give up after retryMaxAttempts.
 func retryOnResourceConflict(ctx context.Context, fn func() error) error {
-	for {
+	for attempt := 1; ; attempt++ {
 		err := fn()
-		switch {
-		case err == nil:
-			return err
-		case strings.Contains(err.Error(), "ARN does not refer to a valid principal"):
-		case strings.Contains(err.Error(), "role defined for the function cannot be assumed"):
-		case strings.Contains(err.Error(), "InUseException"):
-		case strings.Contains(err.Error(), "ConflictException"):
-			if strings.Contains(err.Error(), "exists") {
-				return err
-			}
-		default:
+		if err == nil || !isRetryableError(err) {
 			return err
 		}
-		t := time.NewTimer(time.Second)
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-t.C:
+		if attempt >= retryMaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		d := retryDelay(attempt)
+		verbosef("retrying in %s after transient error: %s", d.Round(time.Millisecond), err)
+		if err := sleepCtx(ctx, d); err != nil {
+			return err
 		}
 	}
 }
@@ -86,11 +198,9 @@ func retry(ctx context.Context, fn func() error, ignore ...string) error {
 		if !doRetry {
 			return err
 		}
-		t := time.NewTimer(time.Second)
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-t.C:
+		verbosef("retrying after error: %s", err)
+		if err := sleepCtx(ctx, time.Second); err != nil {
+			return err
 		}
 	}
 }
@@ -142,24 +252,50 @@ func processDockerResponse(r io.Reader) error {
 	}
 }
 
-// waitOnFunc waits for a lambda function to be ready.
-func waitOnFunc(ctx context.Context, lambdaCl *lambda.Client, fnName string, verAlias string) error {
+// waitOnFunc waits for the given version/alias of a lambda function to become
+// active and for its last update to complete successfully. If the function
+// fails to get there (e.g. the image cannot be pulled), the reason reported by
+// lambda is returned as the error.
+func waitOnFunc(ctx context.Context, lambdaCl *lambda.Client, fnName string, qualifier string) error {
 	for {
-		fOut, err := lambdaCl.GetFunction(ctx, &lambda.GetFunctionInput{
+		cfg, err := lambdaCl.GetFunctionConfiguration(ctx, &lambda.GetFunctionConfigurationInput{
 			FunctionName: &fnName,
-			Qualifier:    &verAlias,
+			Qualifier:    &qualifier,
 		})
 		if err != nil {
 			return fmt.Errorf("failed poll function state: %s", err)
 		}
-		switch s := fOut.Configuration.State; s {
+		switch s := cfg.State; s {
 		case lambdatypes.StateActive:
-			return nil
 		case lambdatypes.StatePending:
-			time.Sleep(2 * time.Second)
+			if err := sleepCtx(ctx, 2*time.Second); err != nil {
+				return err
+			}
 			continue
 		default:
-			return fmt.Errorf("invalid state while polling: %s", s)
+			return fmt.Errorf("invalid state while polling: %s: %s", s, stateReason(string(cfg.StateReasonCode), cfg.StateReason))
 		}
+		switch s := cfg.LastUpdateStatus; s {
+		case lambdatypes.LastUpdateStatusSuccessful, "":
+			return nil
+		case lambdatypes.LastUpdateStatusInProgress:
+			if err := sleepCtx(ctx, 2*time.Second); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("function update failed: %s: %s", s, stateReason(string(cfg.LastUpdateStatusReasonCode), cfg.LastUpdateStatusReason))
+		}
+	}
+}
+
+// stateReason formats the reason code and message lambda reports for a state.
+func stateReason(code string, reason *string) string {
+	r := "no reason given"
+	if reason != nil && *reason != "" {
+		r = *reason
+	}
+	if code != "" {
+		r = fmt.Sprintf("%s (%s)", r, code)
 	}
+	return r
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{-1, retryBaseDelay / 2, retryBaseDelay},
+		{0, retryBaseDelay / 2, retryBaseDelay},
+		{1, retryBaseDelay / 2, retryBaseDelay},
+		{2, retryBaseDelay, 2 * retryBaseDelay},
+		{3, 2 * retryBaseDelay, 4 * retryBaseDelay},
+		{10, retryMaxDelay / 2, retryMaxDelay},
+		{100, retryMaxDelay / 2, retryMaxDelay},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := retryDelay(tt.attempt); d < tt.min || d > tt.max {
+				t.Fatalf("retryDelay(%d) = %s, want between %s and %s", tt.attempt, d, tt.min, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadVarFile loads placeholder vars from the given file. Files with a .yaml,
+// .yml or .json extension must contain a flat map of scalars. Any other file
+// is read as dotenv, i.e. KEY=VALUE lines.
+func loadVarFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read var file: %s", err)
+	}
+
+	var raw map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		vars, err := parseYAMLVars(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse var file '%s': %s", path, err)
+		}
+		return vars, nil
+	case ".json":
+		// Numbers are kept as is so that e.g. account IDs don't turn into
+		// floats.
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		err = dec.Decode(&raw)
+	default:
+		vars, err := parseDotenv(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse var file '%s': %s", path, err)
+		}
+		return vars, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse var file '%s': %s", path, err)
+	}
+
+	vars := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case nil:
+			vars[k] = ""
+		case string:
+			vars[k] = v
+		case json.Number:
+			vars[k] = v.String()
+		case bool:
+			vars[k] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("var '%s' in var file '%s' must be a string, number or bool", k, path)
+		}
+	}
+	return vars, nil
+}
+
+// parseYAMLVars parses a flat YAML map. Scalars are taken as written so that
+// e.g. 012345678901 or 1.10 aren't turned into numbers and lose digits.
+func parseYAMLVars(b []byte) (map[string]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	vars := map[string]string{}
+	if len(doc.Content) == 0 {
+		return vars, nil
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a map of vars", m.Line)
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], m.Content[i+1]
+		if v.Kind == yaml.AliasNode {
+			v = v.Alias
+		}
+		if v.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("line %d: var '%s' must be a string, number or bool", v.Line, k.Value)
+		}
+		if v.ShortTag() == "!!null" {
+			vars[k.Value] = ""
+			continue
+		}
+		vars[k.Value] = v.Value
+	}
+	return vars, nil
+}
+
+// parseDotenv parses KEY=VALUE lines. Empty lines, comments and an "export "
+// prefix are ignored. Values can be single quoted to be taken literally, or
+// double quoted to interpret escapes such as \n.
+func parseDotenv(s string) (map[string]string, error) {
+	vars := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		v = strings.TrimSpace(v)
+		switch {
+		case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+			v = v[1 : len(v)-1]
+		case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+			uv, err := strconv.Unquote(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value: %s", n, err)
+			}
+			v = uv
+		}
+		vars[k] = v
+	}
+	return vars, sc.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadVarFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "vars.yaml",
+			content: "ACCOUNT: 012345678901\nMODE: 0777\nVERSION: 1.10\nDEBUG: true\nNAME: 'quoted'\nEMPTY:\nNULL: ~\n",
+			want: map[string]string{
+				"ACCOUNT": "012345678901",
+				"MODE":    "0777",
+				"VERSION": "1.10",
+				"DEBUG":   "true",
+				"NAME":    "quoted",
+				"EMPTY":   "",
+				"NULL":    "",
+			},
+		},
+		{
+			name:    "empty.yml",
+			content: "",
+			want:    map[string]string{},
+		},
+		{
+			name:    "nested.yaml",
+			content: "A:\n  B: c\n",
+			wantErr: true,
+		},
+		{
+			name:    "list.yaml",
+			content: "- a\n- b\n",
+			wantErr: true,
+		},
+		{
+			name:    "vars.json",
+			content: `{"ACCOUNT": 12345678901234567890, "VERSION": 1.10, "DEBUG": false, "NAME": "x", "EMPTY": null}`,
+			want: map[string]string{
+				"ACCOUNT": "12345678901234567890",
+				"VERSION": "1.10",
+				"DEBUG":   "false",
+				"NAME":    "x",
+				"EMPTY":   "",
+			},
+		},
+		{
+			name:    "nested.json",
+			content: `{"A": {"B": "c"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "vars.env",
+			content: "# comment\n\nexport A=1\nB = two words \nC='single $HOME \\n'\nD=\"double\\tquoted\"\nE=\nF=a=b\n",
+			want: map[string]string{
+				"A": "1",
+				"B": "two words",
+				"C": "single $HOME \\n",
+				"D": "double\tquoted",
+				"E": "",
+				"F": "a=b",
+			},
+		},
+		{
+			name:    "missing-equals.env",
+			content: "A\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad-quote.env",
+			content: "A=\"\\q\"\n",
+			wantErr: true,
+		},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadVarFile(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadVarFile() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadVarFile() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("loadVarFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
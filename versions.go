@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"sort"
 	"strconv"
 
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 )
@@ -20,7 +23,7 @@ const latestPseudoVersion = "latest"
 // aliase names are looked up. "latest" is a special case referring to the
 // latest version of the function. "latest" is NOT the same as lambda's
 // "$LATEST".
-func resolveVersion(fnName string, verSpec string) (int, error) {
+func resolveVersion(ctx context.Context, fnName string, verSpec string) (int, error) {
 	if verSpec == "" {
 		return 0, errors.New("version spec must not be empty")
 	}
@@ -28,21 +31,23 @@ func resolveVersion(fnName string, verSpec string) (int, error) {
 		return v, nil
 	}
 	if verSpec == latestPseudoVersion {
-		vers, err := versions(fnName)
+		vers, err := versions(ctx, fnName, versionsOptions{Newest: 1, NoAliases: true})
 		if err != nil {
 			return 0, fmt.Errorf("failed lookup latest version: %s", err)
 		}
-		return vers[len(vers)-1].Version, nil
+		if len(vers) == 0 {
+			return 0, fmt.Errorf("function '%s' has no published versions", fnName)
+		}
+		return vers[0].Version, nil
 	}
 
 	lookupVer := &verSpec
 
-	ctx := context.Background()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to load aws config: %s", err)
 	}
-	lambdaCl := lambda.NewFromConfig(acfg)
+	lambdaCl := clients.lambda()
 
 	alias, err := lambdaCl.GetAlias(ctx, &lambda.GetAliasInput{
 		FunctionName: &fnName,
@@ -67,19 +72,54 @@ func addVersionFlag(c *pflag.FlagSet, ver *string) {
 	c.StringVarP(ver, "version", "v", activeAlias, "the version/alias of the function (use 'latest' for latest version)")
 }
 
-var versionsCmd = &cobra.Command{
-	Use:     "versions",
-	Aliases: []string{"ver", "version"},
-	Short:   "List versions of a function",
-	Args:    cobra.ExactArgs(1),
-	RunE: func(c *cobra.Command, args []string) error {
-		fnName := args[0]
-		vers, err := versions(fnName)
-		if err != nil {
+var versionsCmd *cobra.Command
+
+func init() {
+	var opts versionsOptions
+	versionsCmd = &cobra.Command{
+		Use:     "versions",
+		Aliases: []string{"ver", "version"},
+		Short:   "List versions of a function",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			fnName := args[0]
+
+			// Templates need all versions at once. Otherwise stream the JSON array
+			// as versions arrive.
+
+			if outputTemplate != "" {
+				vers, err := versions(c.Context(), fnName, opts)
+				if err != nil {
+					return err
+				}
+				return formatOutput(vers)
+			}
+
+			n := 0
+			err := eachVersion(c.Context(), fnName, opts, func(v fnVersion) error {
+				b, err := json.MarshalIndent(v, "  ", "  ")
+				if err != nil {
+					return fmt.Errorf("failed to encode output: %s", err)
+				}
+				if n == 0 {
+					fmt.Print("[\n  ")
+				} else {
+					fmt.Print(",\n  ")
+				}
+				n++
+				_, err = os.Stdout.Write(b)
+				return err
+			})
+			switch {
+			case n == 0 && err == nil:
+				fmt.Println("[]")
+			case n > 0:
+				fmt.Println("\n]")
+			}
 			return err
-		}
-		return formatOutput(vers)
-	},
+		},
+	}
+	versionsCmd.Flags().IntVar(&opts.Newest, "newest", 0, "only list the newest N versions")
 }
 
 // fnVersion represents a version of a function.
@@ -89,68 +129,143 @@ type fnVersion struct {
 	Description string   `json:"description"`
 }
 
-// versions returns a list of all versions of the given function.
-func versions(fnName string) ([]fnVersion, error) {
+// versionsOptions controls the listing of versions.
+type versionsOptions struct {
+	// Newest limits the listing to the newest N versions. Zero means all.
+	Newest int
+	// NoAliases skips looking up the aliases of versions.
+	NoAliases bool
+}
 
+// versions returns a list of the versions of the given function, oldest
+// first.
+func versions(ctx context.Context, fnName string, opts versionsOptions) ([]fnVersion, error) {
 	vs := []fnVersion{}
+	if err := eachVersion(ctx, fnName, opts, func(v fnVersion) error {
+		vs = append(vs, v)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		return vs[i].Version < vs[j].Version
+	})
+	return vs, nil
+}
 
-	ctx := context.Background()
-	acfg, err := awsconfig.LoadDefaultConfig(ctx)
+// eachVersion calls fn with each version of the given function, oldest first.
+// Aliases and pages of versions are fetched concurrently and, unless only the
+// newest versions are asked for, versions are passed to fn as their pages
+// arrive. Lambda only lists versions oldest first so all pages are still
+// fetched for the newest versions, but only the newest are kept.
+func eachVersion(ctx context.Context, fnName string, opts versionsOptions, fn func(fnVersion) error) error {
+	clients, err := awsClientsFrom(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load aws config: %s", err)
+		return fmt.Errorf("failed to load aws config: %s", err)
 	}
-	lambdaCl := lambda.NewFromConfig(acfg)
+	lambdaCl := clients.lambda()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	// Get all aliases and map them from function version to alias name.
 
 	aliases := map[string][]string{}
-	ap := lambda.NewListAliasesPaginator(lambdaCl, &lambda.ListAliasesInput{
-		FunctionName: &fnName,
-	})
-	for ap.HasMorePages() {
-		page, err := ap.NextPage(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list aliases: %s", err)
-		}
-		for _, a := range page.Aliases {
-			fa, fv := *a.Name, *a.FunctionVersion
-			aliases[fv] = append(aliases[fv], fa)
-		}
-	}
-	for _, a := range aliases {
-		sort.StringSlice(a).Sort()
-	}
-
-	p := lambda.NewListVersionsByFunctionPaginator(lambdaCl, &lambda.ListVersionsByFunctionInput{
-		FunctionName: &fnName,
-	})
-	for p.HasMorePages() {
-		page, err := p.NextPage(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list versions: %s", err)
-		}
-		for _, v := range page.Versions {
-			if *v.Version != "$LATEST" {
-				intVer, err := strconv.Atoi(*v.Version)
+	aliasErr := make(chan error, 1)
+	if opts.NoAliases {
+		aliasErr <- nil
+	} else {
+		go func() {
+			ap := lambda.NewListAliasesPaginator(lambdaCl, &lambda.ListAliasesInput{
+				FunctionName: &fnName,
+			})
+			for ap.HasMorePages() {
+				page, err := ap.NextPage(ctx)
 				if err != nil {
-					return nil, fmt.Errorf("failed to convert version to int: %s", err)
+					aliasErr <- fmt.Errorf("failed to list aliases: %s", err)
+					return
 				}
-				al := aliases[*v.Version]
-				if al == nil {
-					al = []string{}
+				for _, a := range page.Aliases {
+					fa, fv := *a.Name, *a.FunctionVersion
+					aliases[fv] = append(aliases[fv], fa)
 				}
-				vs = append(vs, fnVersion{
-					Version:     intVer,
-					Aliases:     al,
-					Description: *v.Description,
-				})
+			}
+			for _, a := range aliases {
+				sort.StringSlice(a).Sort()
+			}
+			aliasErr <- nil
+		}()
+	}
+
+	// Fetch pages of versions ahead of them being processed.
+
+	pages := make(chan []lambdatypes.FunctionConfiguration, 4)
+	pagesErr := make(chan error, 1)
+	go func() {
+		defer close(pages)
+		p := lambda.NewListVersionsByFunctionPaginator(lambdaCl, &lambda.ListVersionsByFunctionInput{
+			FunctionName: &fnName,
+			MaxItems:     aws.Int32(50),
+		})
+		for p.HasMorePages() {
+			page, err := p.NextPage(ctx)
+			if err != nil {
+				pagesErr <- fmt.Errorf("failed to list versions: %s", err)
+				return
+			}
+			select {
+			case pages <- page.Versions:
+			case <-ctx.Done():
+				return
 			}
 		}
+	}()
+
+	if err := <-aliasErr; err != nil {
+		return err
 	}
 
-	sort.Slice(vs, func(i, j int) bool {
-		return vs[i].Version < vs[j].Version
-	})
+	var newest []fnVersion
+	for page := range pages {
+		for _, v := range page {
+			if *v.Version == "$LATEST" {
+				continue
+			}
+			intVer, err := strconv.Atoi(*v.Version)
+			if err != nil {
+				return fmt.Errorf("failed to convert version to int: %s", err)
+			}
+			al := aliases[*v.Version]
+			if al == nil {
+				al = []string{}
+			}
+			fv := fnVersion{
+				Version:     intVer,
+				Aliases:     al,
+				Description: *v.Description,
+			}
+			if opts.Newest <= 0 {
+				if err := fn(fv); err != nil {
+					return err
+				}
+				continue
+			}
+			newest = append(newest, fv)
+			if len(newest) > opts.Newest {
+				newest = newest[1:]
+			}
+		}
+	}
+	select {
+	case err := <-pagesErr:
+		return err
+	default:
+	}
 
-	return vs, nil
+	for _, fv := range newest {
+		if err := fn(fv); err != nil {
+			return err
+		}
+	}
+	return nil
 }